@@ -0,0 +1,77 @@
+package stencil
+
+import (
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// provenances are the provenance of the files generated from a stencil, and of the test files.
+type provenances struct {
+	files, tests *Provenance
+}
+
+// of returns the provenance of the generated file at path.
+func (p provenances) of(path string) *Provenance {
+	if strings.HasSuffix(path, "_test.go") {
+		return p.tests
+	}
+	return p.files
+}
+
+// cached returns true if the stencilled package name in stencilled, read from v, was generated from the
+// stencil files at paths with the provenances provs. Provenance records the hash of the stencil, the substitutions and the version
+// of stencil, so a package generated with the same provenance is up to date and need not be generated again.
+func cached(v *fileSystem, stencilled string, paths []string, provs provenances, name string) bool {
+	for _, p := range paths {
+		target := filepath.Join(stencilled, filepath.Base(p))
+		b, err := v.ReadFile(target)
+		if err != nil {
+			return false
+		}
+		prov := provs.of(target)
+		got, ok := ReadProvenance(b)
+		if !ok || got.Stencil != prov.Stencil || got.Hash != prov.Hash || got.Version != prov.Version ||
+			!reflect.DeepEqual(got.Substitutions, map[string]string(prov.Substitutions)) {
+			return false
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), target, b, parser.PackageClauseOnly)
+		if err != nil || strings.TrimSuffix(f.Name.Name, "_test") != name {
+			return false
+		}
+	}
+	return len(paths) > 0
+}
+
+// generateCached generates the stencilled packages imported by a cached stencilled package, generated in
+// stencilled from the stencil files at paths, so that they are brought up to date as well.
+func (g *generator) generateCached(stencilled string, paths []string, importPath string) error {
+	fs := token.NewFileSet()
+	for _, p := range paths {
+		target := filepath.Join(stencilled, filepath.Base(p))
+		b, err := g.opts.fs.ReadFile(target)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		f, err := parser.ParseFile(fs, target, b, parser.ImportsOnly)
+		if err != nil {
+			return errors.Wrapf(err, "%s: parse failed", target)
+		}
+		for _, imp := range f.Imports {
+			path := imp.Path.Value
+			path = path[1 : len(path)-1]
+			// External tests import the stencilled package itself.
+			if path == importPath {
+				continue
+			}
+			if _, _, _, err := g.generateNamed(path); err != nil {
+				return &Error{Pos: fs.Position(imp.Pos()), Import: path, Err: err}
+			}
+		}
+	}
+	return nil
+}
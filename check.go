@@ -0,0 +1,99 @@
+package stencil
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Drift lists the differences between the stencilled packages generated for a set of paths and the
+// files on disk.
+type Drift struct {
+	// Stale holds files whose contents differ from the generated contents.
+	Stale []string
+	// Missing holds generated files that do not exist.
+	Missing []string
+	// Orphaned holds Go files in the directories of generated packages that are no longer generated, and the
+	// files of stencilled packages that are no longer imported, which Clean removes.
+	Orphaned []string
+}
+
+// Empty returns true if there are no differences.
+func (d *Drift) Empty() bool {
+	return len(d.Stale) == 0 && len(d.Missing) == 0 && len(d.Orphaned) == 0
+}
+
+// Check compares the stencilled packages Process would generate for paths with the files on disk, without
+// writing anything. If tests is true, the tests of stencils are compared as well, as generated by ProcessWithTests.
+func Check(paths []string, tests bool) (*Drift, error) {
+	return NewGenerator(Options{Tests: tests}).Check(context.Background(), paths)
+}
+
+// Check compares the stencilled packages g would generate for paths with the files on disk, without writing anything.
+func (g *Generator) Check(ctx context.Context, paths []string) (*Drift, error) {
+	files, err := g.Generate(ctx, paths)
+	if err != nil {
+		return nil, err
+	}
+	opts := g.options()
+	d, err := drift(opts.fs, files, g.opts.Tests)
+	if err != nil {
+		return nil, err
+	}
+	unused, _, err := unusedPackages(ctx, paths, opts)
+	if err != nil {
+		return nil, err
+	}
+	d.Orphaned = append(d.Orphaned, unused...)
+	sort.Strings(d.Orphaned)
+	return d, nil
+}
+
+// drift compares files with the files read from v.
+func drift(v *fileSystem, files []File, tests bool) (*Drift, error) {
+	d := &Drift{}
+	generated := map[string]bool{}
+	dirs := map[string]bool{}
+	for _, f := range files {
+		generated[f.Path] = true
+		if !f.consumer {
+			dirs[filepath.Dir(f.Path)] = true
+		}
+		b, err := v.ReadFile(f.Path)
+		switch {
+		case os.IsNotExist(err):
+			d.Missing = append(d.Missing, f.Path)
+		case err != nil:
+			return nil, errors.WithStack(err)
+		case !bytes.Equal(b, f.Data):
+			d.Stale = append(d.Stale, f.Path)
+		}
+	}
+	for dir := range dirs {
+		infos, err := v.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, i := range infos {
+			n := i.Name()
+			if i.IsDir() || !strings.HasSuffix(n, ".go") || !tests && strings.HasSuffix(n, "_test.go") {
+				continue
+			}
+			if p := filepath.Join(dir, n); !generated[p] {
+				d.Orphaned = append(d.Orphaned, p)
+			}
+		}
+	}
+	sort.Strings(d.Stale)
+	sort.Strings(d.Missing)
+	sort.Strings(d.Orphaned)
+	return d, nil
+}
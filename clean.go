@@ -0,0 +1,136 @@
+package stencil
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Clean removes stencilled packages that are no longer imported by the packages in paths, returning the
+// removed files. Only files generated by stencil are removed, and directories left empty are deleted.
+// If dryRun is true, the files are returned without being removed.
+//
+// Stencilled packages are shared by all packages using the same output directory, so paths must include
+// every package importing stencilled packages, for instance using a path ending in "/...".
+func Clean(paths []string, dryRun bool) ([]string, error) {
+	return NewGenerator(Options{DryRun: dryRun}).Clean(context.Background(), paths)
+}
+
+// Clean is like the Clean function, using the layout configured for g. If DryRun is set, the files are returned
+// without being removed.
+func (g *Generator) Clean(ctx context.Context, paths []string) ([]string, error) {
+	opts := g.options()
+	if opts.fs.fsys != nil && !g.opts.DryRun {
+		return nil, errors.New("files in an fs.FS cannot be removed")
+	}
+	removed, roots, err := unusedPackages(ctx, paths, opts)
+	if err != nil {
+		return nil, err
+	}
+	if g.opts.DryRun {
+		return removed, nil
+	}
+	for _, p := range removed {
+		if err := os.Remove(p); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		g.logf("removed %s", p)
+	}
+	for root := range roots {
+		for _, p := range removed {
+			removeEmptyDirs(root, filepath.Dir(p))
+		}
+	}
+	return removed, nil
+}
+
+// unusedPackages returns the files of the stencilled packages in the output directories of the packages in paths
+// and of the specializations in opts that are no longer imported, along with the output directories.
+func unusedPackages(ctx context.Context, paths []string, opts options) ([]string, map[string]bool, error) {
+	// Stencilled packages only imported by tests are in use.
+	opts.tests = true
+	files, err := processStencil(ctx, paths, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	used := map[string]bool{}
+	for _, f := range files {
+		if !f.consumer {
+			used[filepath.Dir(f.Path)] = true
+		}
+	}
+
+	dirs, err := listPackages(opts.fs, paths, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	roots := map[string]bool{}
+	for dir := range dirs {
+		l, err := newLayout(dir, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		roots[l.outputDir()] = true
+	}
+	for _, s := range opts.specs {
+		l, _, err := specLayout(s, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		roots[l.outputDir()] = true
+	}
+
+	var unused []string
+	for root := range roots {
+		files, err := unusedFiles(opts.fs, root, used)
+		if err != nil {
+			return nil, nil, err
+		}
+		unused = append(unused, files...)
+	}
+	sort.Strings(unused)
+	return unused, roots, nil
+}
+
+// unusedFiles returns the files generated by stencil in root, read from v, that are not in a directory in used.
+func unusedFiles(v *fileSystem, root string, used map[string]bool) ([]string, error) {
+	var unused []string
+	err := v.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == root {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if info.IsDir() || !strings.HasSuffix(p, ".go") || used[filepath.Dir(p)] {
+			return nil
+		}
+		b, err := v.ReadFile(p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if _, ok := ReadProvenance(b); ok {
+			unused = append(unused, p)
+		}
+		return nil
+	})
+	return unused, err
+}
+
+// removeEmptyDirs removes dir and its parents, up to but excluding root, while they are empty.
+func removeEmptyDirs(root, dir string) {
+	for ; dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil || len(infos) != 0 {
+			return
+		}
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
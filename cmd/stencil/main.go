@@ -3,21 +3,25 @@
 //Usage
 //
 // Given a package with an interface "A", stencil can generate a new package with all uses of "A" replaced by "int" (or any other type).
-// The generated package is stored in the topmost vendor directory of the repo. If no such directory exists, one is created.
+// The generated package is stored in the nearest vendor directory containing the package. If no such directory exists, one is
+// created in the package directory. See Output directories for other locations.
 //
-// As a trivial example, consider a package "github.com/sridharv/stencil/std/num" with a function Max that computes the maximum value of a list of numbers.
+// As a trivial example, consider a package "github.com/sridharv/stencil/std/num" with a type Number and a function Max
+// that computes the maximum value of a list of numbers.
 //
-//	func Max(v...int) int {
+//	type Number float64
+//
+//	func Max(v...Number) Number {
 //		// compute max
 //	}
 //
-// This only works for int, but we need a version of Max that works on float32.
+// This only works for float64, but we need a version of Max that works on float32.
 // stencil can automatically generate an float32 version by reading an import path with the substitution.
 //
 // Import the float32 version
 //
 //  import (
-//  	float32_num "github.com/sridharv/stencil/std/num/int/float32"
+//  	float32_num "github.com/sridharv/stencil/std/num/Number/float32"
 //  )
 //
 // and use it in your code
@@ -25,14 +29,51 @@
 //		fmt.Println("Max of", values, "=", float32_num.Max(values...))
 //	}
 //
-// This will not compile, since the "github.com/sridharv/stencil/std/num/int/float32" package doesn't exist yet. So in your package directory run
+// This will not compile, since the "github.com/sridharv/stencil/std/num/Number/float32" package doesn't exist yet. So in your package directory run
 //
 //	stencil
 //
-// This generates a "stencilled" version of the package having int substituted with float32. You can now use it in your code
+// This generates a "stencilled" version of the package having Number substituted with float32. You can now use it in your code
 // If your repo has a vendor directory, this will generate the float32 stencilled version in that vendor directory.
 // If not, a vendor directory will be created in your package directory and the stencilled version is generated there.
 //
+//Generated files
+//
+// Every generated file starts with the standard comment marking generated Go code, followed by its provenance:
+// the import path of the stencil, a hash of the stencil's files, the substitutions applied and the version of
+// stencil used. The hash only covers the tests of the stencil in generated test files, so generating tests with -t
+// leaves the other files unchanged.
+//
+//	// Code generated by stencil. DO NOT EDIT.
+//	//
+//	// Stencil: github.com/sridharv/stencil/std/slice
+//	// Hash: sha256:cd63f43458596c5709d71313450ac30119cd1bbeeafb1e199cca51412ad98201
+//	// Substitutions: T=int
+//	// Version: 0.2.0
+//
+// Edit the stencil and run stencil again instead of editing generated files.
+//
+// The provenance also lets stencil skip stencilled packages that are up to date: a package is only generated
+// again if the stencil's files, the substitutions or the version of stencil changed. Files are only written
+// if their contents change. Delete a stencilled package to force it to be generated again.
+//
+//Modules
+//
+// If the package is part of a Go module, stencils are located using the module graph, so stencils in
+// dependencies listed in go.mod, replaced modules and the module cache can all be used.
+// Stencilled packages are generated in the "generated" directory at the root of the module, and imports of
+// stencilled packages are rewritten to refer to the generated package. For example, in the module
+// "example.com/app" the import
+//
+//	int_slice "github.com/sridharv/stencil/std/slice/T/int"
+//
+// is rewritten to
+//
+//	int_slice "example.com/app/generated/github.com/sridharv/stencil/std/slice/T/int"
+//
+// Running stencil again on the rewritten import regenerates the stencilled package.
+// Set GO111MODULE=off to use GOPATH and vendor directories instead.
+//
 //Supported Types
 //
 // The set of types that can be replaced are currently restricted to the following:
@@ -44,6 +85,243 @@
 //	* interface{} - Use interface in the import path
 //
 // These types can be replaced with the same set of types as above, with the exception of interface{}.
+// They can also be replaced with qualified, pointer, slice, array, map and channel types, written in the import
+// path using the following grammar
+//
+//	Type      = Name | Qualified | Pointer | Slice | Array | Map | Chan
+//	Name      = identifier
+//	Qualified = PkgPath "." identifier
+//	PkgPath   = import path with each "/" written as "+"
+//	Pointer   = "ptr" "~" Type
+//	Slice     = "slice" "~" Type
+//	Array     = "array" "~" length "~" Type
+//	Map       = "map" "~" Type "~" Type
+//	Chan      = ( "chan" | "recvchan" | "sendchan" ) "~" Type
+//
+// For example
+//
+//	"github.com/sridharv/stencil/std/slice/T/ptr~bytes.Buffer"                  // *bytes.Buffer
+//	"github.com/sridharv/stencil/std/slice/T/time.Duration"                     // time.Duration
+//	"github.com/sridharv/stencil/std/slice/T/slice~byte"                        // []byte
+//	"github.com/sridharv/stencil/std/slice/T/map~string~example.com+user.ID"    // map[string]user.ID
+//
+// Packages used by the replacement type are imported in the generated files.
+//
+// The stencil is type checked before replacement, so only identifiers that refer to a replaced type are changed.
+// Fields, methods, variables and package names that happen to share the name of a replaced type are left untouched.
+//
+//Declaring parameters
+//
+// A stencil can declare which of its types are parameters by marking their declarations with a //stencil:param
+// comment
+//
+//	// T is the type of the elements of the slices.
+//	//
+//	//stencil:param
+//	type T interface{}
+//
+// or, for a type in a grouped declaration, a //stencil:param comment at the end of its line. Only the parameters
+// of a stencil declaring parameters can be substituted, unless -permissive is used. Any type can be substituted
+// in a stencil that declares none.
+//
+//Default parameters
+//
+// A parameter can give the type replacing it when an import path does not substitute it
+//
+//	//stencil:param default=string
+//	type K interface{}
+//
+// so that an import path need only list the parameters that differ from their defaults. If K and V default to
+// string and int, "example.com/collections/cache/V/float64" replaces K with string and V with float64, while
+// "example.com/collections/cache/_" replaces both with their defaults. The defaults of a stencil can also be
+// set or overridden in a configuration file, described below.
+//
+//Multiple parameters
+//
+// A stencil with several parameters can be specialized by adding a parameter and type pair to the import path for
+// each parameter. Since the pairs are found by removing them from the end of the path until a package exists, this
+// can pick the wrong stencil if a parameter and type happen to name a real package. Separating the stencil from
+// its parameters with a "_" element avoids this
+//
+//	"example.com/collections/cache/_/K/string/V/ptr~example.com+user.User"
+//
+// With this syntax every element after the "_" must be a parameter name followed by a type, each parameter can be
+// substituted once and the stencil must exist.
+//
+// With either syntax, every substituted parameter must be a type declared in the stencil or a predeclared type it
+// uses. Otherwise stencil fails, suggesting the closest type in the stencil if the parameter looks like a typo.
+//
+//Constraints
+//
+// A type in a stencil declared as an interface with methods acts as a constraint on the types replacing it.
+// For example, with
+//
+//	type T interface {
+//		Less(T) bool
+//	}
+//
+// T can only be replaced by types having a method Less with T replaced in its signature. Replacing T by int
+// fails with an error naming the importing file, the import path and the missing methods.
+//
+//Stencils using stencils
+//
+// A stencil can import other stencils, specialized using its own types. For example, a set stencil with the type
+// parameter Element can use the slice stencil by importing
+//
+//	elements "github.com/sridharv/stencil/std/slice/T/Element"
+//
+// When the set is specialized with Element replaced by string, the import is rewritten to
+// "github.com/sridharv/stencil/std/slice/T/string" and that package is generated as well.
+// Import cycles between stencilled packages are reported as errors.
+//
+//Tests
+//
+// Running
+//
+//	stencil -t
+//
+// also specializes the tests of stencils, including external tests in a _test package, so that
+//
+//	go test ./vendor/github.com/sridharv/stencil/std/slice/T/int
+//
+// runs the tests of the slice stencil against the int specialization. Test files in the importing package are
+// also checked for imports of stencilled packages.
+//
+//Output directories
+//
+// The directory stencilled packages are generated in is selected using -o, which takes one of
+//
+//	vendor        the nearest vendor directory containing the package, or a new one in the package
+//	root-vendor   the vendor directory at the root of the repository
+//	generated     the generated directory at the root of the repository, or of the module
+//
+// or any other directory. Only generated and directories in the module can be used in a module. Unless the
+// directory is a vendor directory, imports of stencilled packages are rewritten to import the generated packages.
+// By default, the nearest vendor directory is used, or generated in a module.
+//
+// The output directory can also be set in a configuration file, described below. -o takes precedence.
+//
+//Configuration
+//
+// A stencil.yaml or stencil.json file configures stencil for the directory tree it is in. stencil uses the file
+// in the working directory or the closest directory containing it, whichever its format, and fails if a directory
+// has both. The file sets the output directory, whether
+// to format files as with -w, rename packages as with -rename and substitute any type as with -permissive, and lists
+// stencilled packages to generate even if nothing imports them yet
+//
+//	output: generated
+//	format: true
+//	specializations:
+//	  - stencil: github.com/sridharv/stencil/std/slice
+//	    substitutions: {T: int}
+//	    package: ints
+//	  - stencil: example.com/collections/cache
+//	    substitutions: {K: string, V: ptr~example.com+user.User}
+//	    output: internal/cache
+//	defaults:
+//	  example.com/collections/cache: {K: int64}
+//
+// Each specialization generates the stencilled package importing the stencil path followed by the "_" marker and
+// its substitutions, sorted by the names of the replaced types, like "github.com/sridharv/stencil/std/slice/_/T/int"
+// or "example.com/collections/cache/_/K/string/V/ptr~example.com+user.User". Specializations are located
+// and generated as if imported by a package in the directory of the configuration file, optionally in their
+// own output directory and with their own package name. Relative output directories are relative to the
+// directory of the configuration file. Parameters a specialization leaves out are replaced by their defaults,
+// which defaults sets for the stencils at its import paths, overriding their //stencil:param comments. The
+// equivalent JSON uses the same keys
+//
+//	{"output": "generated", "specializations": [{"stencil": "github.com/sridharv/stencil/std/slice", "substitutions": {"T": "int"}}]}
+//
+//Package names
+//
+// Stencilled packages keep the package name and comments of their stencil. Running
+//
+//	stencil -rename
+//
+// instead names each stencilled package after the types replacing its parameters, so that
+// "github.com/sridharv/stencil/std/slice/T/int" is the package intslice, and replaces the names of parameters
+// in its comments with those types, so that its documentation describes the specialized package.
+// Code importing the package without naming the import must then refer to it by its new name.
+// Pass -rename to stencil check as well when checking renamed packages.
+//
+//Errors
+//
+// stencil exits with a non-zero status if any stencilled package could not be generated. Every failing import
+// is reported, prefixed with its position as file:line:column. With the -json flag, errors are instead written to
+// stdout as a stream of JSON objects, one per failing import, of the form
+//
+//	{"File": "/path/to/use.go", "Line": 4, "Column": 2, "Import": "sorted/T/int", "Message": "..."}
+//
+// With -failfast, stencil stops generating stencilled packages after the first error and only reports it.
+//
+//Dry runs
+//
+// Running
+//
+//	stencil -n [path...]
+//
+// lists the files that would be written, without writing them. Up to date stencilled packages are not listed. Running
+//
+//	stencil -d [path...]
+//
+// prints a unified diff between the files that would be written and the existing files. Diffs require the diff command.
+//
+//Checking generated packages
+//
+// Running
+//
+//	stencil check [-t] [-rename] [-o output] [path...]
+//
+// compares the stencilled packages that would be generated with the files on disk, without writing anything.
+// It lists stale files, whose contents differ, missing files, and orphaned Go files in the directories of generated
+// packages that are no longer generated, including the files stencil clean would remove. It exits with status 1 if there are differences and 2 on errors,
+// making it suitable for use in CI. Use ./check to refer to a directory named check.
+//
+//Removing unused packages
+//
+// Running
+//
+//	stencil clean [-n] [-o output] ./...
+//
+// removes stencilled packages that are no longer imported by any package in the tree, printing the removed files.
+// Only files generated by stencil are removed. Since stencilled packages are shared by all packages generating
+// into the same directory, pass every package importing stencilled packages. With -n, the files are only listed.
+//
+//Migrating to type parameters
+//
+// Running
+//
+//	stencil migrate [-n] [-d] [-rename] [-o output] stencil [path...]
+//
+// converts the stencil at the import path stencil into a package using type parameters, and rewrites the packages
+// in paths importing its stencilled packages to import it instead. The parameters of the stencil become the type
+// parameters of every function and type using them, constrained by the operations they are used with: any,
+// comparable, cmp.Ordered or a number or integer constraint declared in the package. Parameters declared as
+// interfaces with methods keep those methods in their constraints. A stencil declaring no parameters with
+// //stencil:param comments has its interface types as parameters. Package level variables using parameters
+// become functions returning their values.
+//
+// References in importing packages to the functions and types of the stencil are instantiated with the types
+// that replaced the parameters, so that
+//
+//	int_slice.Index(ints, 2)
+//
+// becomes
+//
+//	slice.Index[int](ints, 2)
+//
+// The stencil is rewritten in place, so it must be part of the main module or a GOPATH workspace. Stencils in the
+// module cache, in GOROOT or in vendor directories are not migrated. Stencils with tests are not migrated, since
+// their tests refer to the declarations of the parameters. Stencilled packages are left in place, so that stencil
+// clean can remove them once nothing imports them. With -n, the files that would be written are listed and with -d
+// their diffs are printed.
+//
+//Parallel generation
+//
+// Stencilled packages are generated in parallel, by GOMAXPROCS goroutines unless a different number is set
+// using -p. The files generated do not depend on the number of goroutines. Use -v to log the files written.
+//
+// Programs can generate stencilled packages without running stencil, using stencil.NewGenerator.
 //
 //With go generate
 //
@@ -64,16 +342,28 @@
 // 	stencil -w <path/to/file>
 // will also run goimports on your code, while generating any needed stencilled packages.
 // You can add this as a separate command to run on save in your editor.
+//
+// Editors can generate stencilled packages for unsaved files using -overlay, which takes a JSON file in the
+// format used by go build -overlay, mapping the paths of files to files holding their unsaved contents.
+//
+//	{"Replace": {"/path/to/use.go": "/tmp/unsaved-use.go"}}
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
+	"os/exec"
 
 	"path/filepath"
 
 	"flag"
 
+	"github.com/pkg/errors"
 	"github.com/sridharv/stencil"
 )
 
@@ -83,18 +373,298 @@ func usage() {
 }
 
 func main() {
-	var w bool
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(check(os.Args[2:]))
+		case "clean":
+			os.Exit(clean(os.Args[2:]))
+		case "migrate":
+			os.Exit(migrate(os.Args[2:]))
+		}
+	}
+
+	var w, t, n, d, j, v, rename, permissive, failFast bool
+	var p int
+	var overlay, o string
 	flag.BoolVar(&w, "w", false, "If true, the input files are overwritten after formatting")
+	flag.BoolVar(&t, "t", false, "If true, the tests of stencils are specialized along with the stencils")
+	flag.BoolVar(&n, "n", false, "If true, the files that would be written are listed instead of writing them")
+	flag.BoolVar(&d, "d", false, "If true, diffs of the files that would be written are printed instead of writing them")
+	flag.BoolVar(&j, "json", false, "If true, errors are written to stdout as a stream of JSON objects")
+	flag.BoolVar(&v, "v", false, "If true, the files written are logged to stderr")
+	flag.BoolVar(&rename, "rename", false, "If true, stencilled packages are named after their substitutions")
+	flag.BoolVar(&permissive, "permissive", false, "If true, types not marked as parameters of stencils can be substituted")
+	flag.BoolVar(&failFast, "failfast", false, "If true, generation stops after the first error instead of reporting the errors of all imports")
+	flag.IntVar(&p, "p", 0, "The number of stencilled packages generated in parallel. Defaults to GOMAXPROCS")
+	flag.StringVar(&o, "o", "", "The directory stencilled packages are generated in: vendor, root-vendor, generated or a directory")
+	flag.StringVar(&overlay, "overlay", "", "A JSON file in the format used by go build -overlay, replacing the contents of files")
 
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage:")
-		fmt.Fprintln(os.Stderr, "stencil [-w] [path...]")
+		fmt.Fprintln(os.Stderr, "stencil [-w] [-t] [-n] [-d] [-v] [-rename] [-permissive] [-o output] [-p n] [-overlay file] [-json] [-failfast] [path...]")
+		fmt.Fprintln(os.Stderr, "stencil check [-t] [-rename] [-o output] [path...]")
+		fmt.Fprintln(os.Stderr, "stencil clean [-n] [-o output] [path...]")
+		fmt.Fprintln(os.Stderr, "stencil migrate [-n] [-d] [-rename] [-o output] stencil [path...]")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
-	if err := stencil.Process(flag.Args(), w); err != nil {
+	opts := stencil.Options{Format: w, Tests: t, Workers: p, DryRun: n || d, Rename: rename, Permissive: permissive, FailFast: failFast}
+	if v {
+		opts.Logger = log.New(os.Stderr, "", 0)
+	}
+	err := configure(&opts, o)
+	if err != nil {
+		report(err, j)
+		os.Exit(1)
+	}
+	if overlay != "" {
+		if opts.Overlay, err = readOverlay(overlay); err != nil {
+			report(err, j)
+			os.Exit(1)
+		}
+	}
+	g := stencil.NewGenerator(opts)
+
+	files, err := g.Process(context.Background(), flag.Args())
+	if err == nil && opts.DryRun {
+		err = dryRun(files, n, d)
+	}
+	if err != nil {
+		report(err, j)
+		os.Exit(1)
+	}
+}
+
+// configure configures opts using the stencil.yaml or stencil.json file for the working directory, if any, and output,
+// the value of the -o flag.
+func configure(opts *stencil.Options, output string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	c, err := stencil.FindConfig(wd)
+	if err != nil {
+		return err
+	}
+	if c != nil {
+		c.Apply(opts)
+	}
+	if output != "" {
+		opts.SetOutput(output, wd)
+	}
+	return nil
+}
+
+// jsonError is the JSON representation of an error, written when the -json flag is set.
+type jsonError struct {
+	File    string `json:",omitempty"`
+	Line    int    `json:",omitempty"`
+	Column  int    `json:",omitempty"`
+	Import  string `json:",omitempty"`
+	Message string
+}
+
+// report reports err to stderr, or as JSON objects to stdout if asJSON is true.
+func report(err error, asJSON bool) {
+	if !asJSON {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return
 	}
+	enc := json.NewEncoder(os.Stdout)
+	errs, ok := errors.Cause(err).(stencil.Errors)
+	if !ok {
+		enc.Encode(jsonError{Message: err.Error()})
+		return
+	}
+	for _, e := range errs {
+		enc.Encode(jsonError{
+			File:    e.Pos.Filename,
+			Line:    e.Pos.Line,
+			Column:  e.Pos.Column,
+			Import:  e.Import,
+			Message: e.Err.Error(),
+		})
+	}
+}
+
+// readOverlay reads the overlay described by the JSON file at path, in the format used by go build -overlay.
+func readOverlay(path string) (map[string][]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var o struct{ Replace map[string]string }
+	if err := json.Unmarshal(b, &o); err != nil {
+		return nil, errors.Wrapf(err, "%s: invalid overlay", path)
+	}
+	overlay := map[string][]byte{}
+	for p, r := range o.Replace {
+		if overlay[p], err = ioutil.ReadFile(r); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return overlay, nil
+}
+
+// dryRun prints files, the files that would be written. If list is true their paths are printed and if
+// diff is true a unified diff against the existing files is printed.
+func dryRun(files []stencil.File, list, diff bool) error {
+	for _, f := range files {
+		if list {
+			fmt.Println(f.Path)
+		}
+		if !diff {
+			continue
+		}
+		old, err := ioutil.ReadFile(f.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if bytes.Equal(old, f.Data) {
+			continue
+		}
+		out, err := unifiedDiff(f.Path, old, f.Data)
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(out)
+	}
+	return nil
+}
+
+// unifiedDiff returns a unified diff between b1 and b2, the old and new contents of path, using the diff command.
+func unifiedDiff(path string, b1, b2 []byte) ([]byte, error) {
+	f1, err := writeTemp(b1)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f1)
+	f2, err := writeTemp(b2)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f2)
+
+	data, err := exec.Command("diff", "-u", "--label", path+".orig", "--label", path, f1, f2).CombinedOutput()
+	if len(data) > 0 {
+		// diff exits with a non-zero status when the files don't match.
+		// Ignore that failure as long as we get output.
+		err = nil
+	}
+	return data, err
+}
+
+func writeTemp(b []byte) (string, error) {
+	f, err := ioutil.TempFile("", "stencil")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// check reports differences between generated packages and files on disk, returning the exit status.
+func check(args []string) int {
+	fl := flag.NewFlagSet("check", flag.ExitOnError)
+	t := fl.Bool("t", false, "If true, the tests of stencils are checked as well")
+	rename := fl.Bool("rename", false, "If true, stencilled packages are checked as named after their substitutions")
+	o := fl.String("o", "", "The directory stencilled packages are generated in: vendor, root-vendor, generated or a directory")
+	fl.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "stencil check [-t] [-rename] [-o output] [path...]")
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+
+	opts := stencil.Options{Tests: *t, Rename: *rename}
+	if err := configure(&opts, *o); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 2
+	}
+	d, err := stencil.NewGenerator(opts).Check(context.Background(), fl.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 2
+	}
+	for _, p := range d.Stale {
+		fmt.Println("stale:", p)
+	}
+	for _, p := range d.Missing {
+		fmt.Println("missing:", p)
+	}
+	for _, p := range d.Orphaned {
+		fmt.Println("orphaned:", p)
+	}
+	if !d.Empty() {
+		return 1
+	}
+	return 0
+}
+
+// clean removes stencilled packages that are no longer imported, returning the exit status.
+func clean(args []string) int {
+	fl := flag.NewFlagSet("clean", flag.ExitOnError)
+	n := fl.Bool("n", false, "If true, the files that would be removed are listed without removing them")
+	o := fl.String("o", "", "The directory stencilled packages are generated in: vendor, root-vendor, generated or a directory")
+	fl.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "stencil clean [-n] [-o output] [path...]")
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+
+	opts := stencil.Options{DryRun: *n}
+	err := configure(&opts, *o)
+	var removed []string
+	if err == nil {
+		removed, err = stencil.NewGenerator(opts).Clean(context.Background(), fl.Args())
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	for _, p := range removed {
+		fmt.Println(p)
+	}
+	return 0
+}
+
+// migrate converts a stencil into a package using type parameters, returning the exit status.
+func migrate(args []string) int {
+	fl := flag.NewFlagSet("migrate", flag.ExitOnError)
+	n := fl.Bool("n", false, "If true, the files that would be written are listed instead of writing them")
+	d := fl.Bool("d", false, "If true, diffs of the files that would be written are printed instead of writing them")
+	rename := fl.Bool("rename", false, "If true, stencilled packages are named after their substitutions")
+	o := fl.String("o", "", "The directory stencilled packages are generated in: vendor, root-vendor, generated or a directory")
+	fl.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "stencil migrate [-n] [-d] [-rename] [-o output] stencil [path...]")
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	if fl.NArg() == 0 {
+		fl.Usage()
+		return 2
+	}
+
+	opts := stencil.Options{DryRun: *n || *d, Rename: *rename}
+	err := configure(&opts, *o)
+	var files []stencil.File
+	if err == nil {
+		files, err = stencil.NewGenerator(opts).Migrate(context.Background(), fl.Arg(0), fl.Args()[1:])
+	}
+	if err == nil && opts.DryRun {
+		err = dryRun(files, *n, *d)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,204 @@
+package stencil
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFiles are the names of the files configuring stencil for the directory tree they are in, in YAML or JSON.
+var ConfigFiles = []string{"stencil.yaml", "stencil.json"}
+
+// Config configures stencil for the packages in the directory tree rooted at the directory of its config file.
+type Config struct {
+	// Output is the directory stencilled packages are generated in. It is either the name of an OutputMode,
+	// or a directory, relative to the directory of the config file unless absolute.
+	Output string `json:"output" yaml:"output"`
+	// Format runs goimports on the processed files after generating.
+	Format bool `json:"format" yaml:"format"`
+	// Rename names stencilled packages after their substitutions, as described for Options.
+	Rename bool `json:"rename" yaml:"rename"`
+	// Permissive allows substituting types not marked as parameters, as described for Options.
+	Permissive bool `json:"permissive" yaml:"permissive"`
+	// Specializations are stencilled packages to generate, whether or not they are imported.
+	Specializations []Specialization `json:"specializations" yaml:"specializations"`
+	// Defaults maps the import paths of stencils to the defaults of their parameters, as described for Options.
+	Defaults map[string]map[string]string `json:"defaults" yaml:"defaults"`
+	// Dir is the directory of the config file.
+	Dir string `json:"-" yaml:"-"`
+}
+
+// A Specialization is a stencilled package to generate, whether or not it is imported.
+type Specialization struct {
+	// Stencil is the import path of the stencil.
+	Stencil string `json:"stencil" yaml:"stencil"`
+	// Substitutions maps the types replaced in the stencil to the types replacing them, written as in import paths.
+	// The stencilled import path of the package separates them from the stencil with the "_" marker and lists
+	// them sorted by the names of the replaced types, so that {T: int} specializes std/slice as std/slice/_/T/int
+	// and {V: int, K: string} specializes a cache as cache/_/K/string/V/int. Parameters left out are replaced by
+	// their defaults.
+	Substitutions map[string]string `json:"substitutions" yaml:"substitutions"`
+	// Output, if set, is the directory the package is generated in instead of the configured one. It is
+	// interpreted like Config.Output.
+	Output string `json:"output" yaml:"output"`
+	// Package, if set, is the package name of the generated package.
+	Package string `json:"package" yaml:"package"`
+	// Dir is the directory the stencil is located from, as if imported by a package in Dir. A relative Output is
+	// relative to Dir. If empty, the working directory is used.
+	Dir string `json:"-" yaml:"-"`
+	// file is the config file declaring the specialization, if any.
+	file string
+}
+
+// path returns the stencilled import path of s. The "_" marker is always used, so that the stencil is not
+// misparsed if a parameter and its type happen to name a package.
+func (s *Specialization) path() string {
+	keys := make([]string, 0, len(s.Substitutions))
+	for k := range s.Substitutions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	elems := []string{s.Stencil, paramMarker}
+	for _, k := range keys {
+		elems = append(elems, k, s.Substitutions[k])
+	}
+	return strings.Join(elems, "/")
+}
+
+// packageNames returns the package names of specs, keyed by their stencilled import paths.
+func packageNames(specs []Specialization) map[string]string {
+	names := map[string]string{}
+	for _, s := range specs {
+		if s.Package != "" {
+			names[s.path()] = s.Package
+		}
+	}
+	return names
+}
+
+// FindConfig reads the config file in dir or the closest directory containing dir that has one, either
+// stencil.yaml or stencil.json. The closest file is used whichever its format, and a directory with both is an
+// error. It returns nil if there is no config file.
+func FindConfig(dir string) (*Config, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		var found string
+		for _, n := range ConfigFiles {
+			p := filepath.Join(d, n)
+			_, err := os.Stat(p)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if found != "" {
+				return nil, errors.Errorf("%s: both %s and %s configure stencil", d, filepath.Base(found), n)
+			}
+			found = p
+		}
+		if found != "" {
+			return ReadConfig(found)
+		}
+		if d == filepath.Dir(d) {
+			return nil, nil
+		}
+	}
+}
+
+// ReadConfig reads the config file at path, in YAML if its name ends in .yaml or .yml and in JSON otherwise.
+func ReadConfig(path string) (*Config, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c := &Config{Dir: filepath.Dir(path)}
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		err = yaml.Unmarshal(b, c)
+	} else {
+		err = json.Unmarshal(b, c)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: invalid config", path)
+	}
+	for i := range c.Specializations {
+		s := &c.Specializations[i]
+		if s.Stencil == "" {
+			return nil, errors.Errorf("%s: specialization %d has no stencil", path, i+1)
+		}
+		s.Dir, s.file = c.Dir, path
+	}
+	for stencil, defaults := range c.Defaults {
+		for k, v := range defaults {
+			if _, err := parseTypePath(v); err != nil {
+				return nil, errors.Wrapf(err, "%s: default of %s in %s", path, k, stencil)
+			}
+		}
+	}
+	return c, nil
+}
+
+// parseOutput returns the output mode and directory for output, either the name of an OutputMode or a directory,
+// relative to dir unless absolute.
+func parseOutput(output, dir string) (OutputMode, string) {
+	if m, err := ParseOutputMode(output); err == nil {
+		return m, ""
+	}
+	if !filepath.IsAbs(output) {
+		output = filepath.Join(dir, output)
+	}
+	return DefaultOutput, output
+}
+
+// SetOutput sets the directory stencilled packages are generated in to output, either the name of an OutputMode
+// or a directory, relative to dir unless absolute.
+func (o *Options) SetOutput(output, dir string) {
+	o.Output, o.OutputDir = parseOutput(output, dir)
+}
+
+// Apply configures opts using c.
+func (c *Config) Apply(opts *Options) {
+	if c.Output != "" {
+		opts.SetOutput(c.Output, c.Dir)
+	}
+	opts.Format = opts.Format || c.Format
+	opts.Rename = opts.Rename || c.Rename
+	opts.Permissive = opts.Permissive || c.Permissive
+	opts.Specializations = append(opts.Specializations, c.Specializations...)
+	for stencil, defaults := range c.Defaults {
+		if opts.Defaults == nil {
+			opts.Defaults = map[string]map[string]string{}
+		}
+		if opts.Defaults[stencil] == nil {
+			opts.Defaults[stencil] = map[string]string{}
+		}
+		for k, v := range defaults {
+			if _, ok := opts.Defaults[stencil][k]; !ok {
+				opts.Defaults[stencil][k] = v
+			}
+		}
+	}
+}
+
+// defaultReplacers returns defaults, which map the import paths of stencils to the defaults of their parameters,
+// as replacers.
+func defaultReplacers(defaults map[string]map[string]string) map[string]replacer {
+	rs := map[string]replacer{}
+	for stencil, d := range defaults {
+		rs[stencil] = replacer(d)
+	}
+	return rs
+}
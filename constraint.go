@@ -0,0 +1,113 @@
+package stencil
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strings"
+
+	"josharian/apply"
+
+	"github.com/pkg/errors"
+)
+
+// checkConstraints verifies that the types replacing interfaces declared in a stencil implement them.
+// Replacement types that cannot be resolved are not checked.
+func (g *generator) checkConstraints(fs *token.FileSet, pkg *types.Package, info *types.Info, files map[string]*ast.File, s *substitution) error {
+	if pkg == nil {
+		return nil
+	}
+	for _, f := range files {
+		for _, d := range f.Decls {
+			gd, ok := d.(*ast.GenDecl)
+			if !ok || gd.Tok != token.TYPE {
+				continue
+			}
+			for _, sp := range gd.Specs {
+				spec := sp.(*ast.TypeSpec)
+				obj := info.Defs[spec.Name]
+				rep, ok := s.objs[obj]
+				if !ok {
+					continue
+				}
+				iface, ok := obj.Type().Underlying().(*types.Interface)
+				if !ok || iface.NumMethods() == 0 {
+					continue
+				}
+				if err := g.checkConstraint(fs, f, spec, s, pkg.Name()+"."+obj.Name(), rep); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkConstraint checks that rep implements the interface declared by spec in f. The interface, with replaced
+// types substituted, is type checked along with rep in a package in the importing directory.
+func (g *generator) checkConstraint(fs *token.FileSet, f *ast.File, spec *ast.TypeSpec, s *substitution, name, rep string) error {
+	// Specs of replaced types are deleted during generation, so it is safe to substitute in place.
+	apply.Apply(spec.Type, s.preReplace, nil)
+	var iface bytes.Buffer
+	if err := format.Node(&iface, fs, spec.Type); err != nil {
+		return errors.Wrapf(err, "%s: failed to print constraint", name)
+	}
+
+	var src bytes.Buffer
+	fmt.Fprintln(&src, "package stencilconstraint")
+	for _, imp := range f.Imports {
+		fmt.Fprintf(&src, "import %s %s\n", importName(imp), imp.Path.Value)
+	}
+	for p, n := range s.imports {
+		fmt.Fprintf(&src, "import %s %q\n", n, p)
+	}
+	fmt.Fprintf(&src, "type constraint %s\n", iface.String())
+	fmt.Fprintf(&src, "type replacement = %s\n", rep)
+
+	cfs := token.NewFileSet()
+	cf, err := parser.ParseFile(cfs, filepath.Join(g.dir, "stencil_constraint.go"), src.Bytes(), 0)
+	if err != nil {
+		return errors.Wrapf(err, "%s: invalid constraint", name)
+	}
+	conf := types.Config{Importer: g.imp, Error: func(error) {}}
+	cpkg, _ := conf.Check("stencilconstraint", cfs, []*ast.File{cf}, nil)
+
+	want, ok := cpkg.Scope().Lookup("constraint").Type().Underlying().(*types.Interface)
+	have := cpkg.Scope().Lookup("replacement").Type()
+	if !ok || have.Underlying() == types.Typ[types.Invalid] {
+		return nil
+	}
+
+	ms := types.NewMethodSet(have)
+	q := func(p *types.Package) string { return p.Name() }
+	var problems []string
+	for i := 0; i < want.NumMethods(); i++ {
+		m := want.Method(i)
+		sel := ms.Lookup(m.Pkg(), m.Name())
+		switch {
+		case sel == nil:
+			problems = append(problems, "missing method "+m.Name()+strings.TrimPrefix(types.TypeString(m.Type(), q), "func"))
+		case !types.Identical(sel.Obj().Type(), m.Type()):
+			problems = append(problems, fmt.Sprintf("wrong type for method %s: have %s, want %s", m.Name(),
+				types.TypeString(sel.Obj().Type(), q), types.TypeString(m.Type(), q)))
+		}
+	}
+	if len(problems) != 0 {
+		return errors.Errorf("%s does not satisfy %s: %s", rep, name, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// importName returns the name used to refer to imp in the file importing it.
+func importName(imp *ast.ImportSpec) string {
+	if imp.Name != nil {
+		return imp.Name.Name
+	}
+	p := imp.Path.Value
+	return packageName(p[1 : len(p)-1])
+}
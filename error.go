@@ -0,0 +1,49 @@
+package stencil
+
+import (
+	"go/token"
+	"strings"
+)
+
+// Error is an error generating the stencilled package imported at a position in a Go file.
+type Error struct {
+	// Pos is the position of the import.
+	Pos token.Position
+	// Import is the imported path.
+	Import string
+	// Err is the cause of the error.
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Pos.String() + ": " + e.Import + ": " + e.Err.Error()
+}
+
+// Cause returns the cause of the error.
+func (e *Error) Cause() error { return e.Err }
+
+// Errors is a list of errors encountered while generating stencilled packages.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e Errors) Len() int      { return len(e) }
+func (e Errors) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+// Less orders errors by position.
+func (e Errors) Less(i, j int) bool {
+	a, b := e[i].Pos, e[j].Pos
+	if a.Filename != b.Filename {
+		return a.Filename < b.Filename
+	}
+	if a.Line != b.Line {
+		return a.Line < b.Line
+	}
+	return a.Column < b.Column
+}
@@ -0,0 +1,197 @@
+package stencil
+
+import (
+	"bytes"
+	"go/build"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileSystem reads the files of stencils and of the packages importing them, either from disk or from an fs.FS.
+// Files in an overlay replace the files at their paths, so that unsaved files can be used.
+type fileSystem struct {
+	// fsys, if set, holds the files instead of the disk. An absolute path refers to the file in fsys at
+	// the path without the leading separator.
+	fsys fs.FS
+	// overlay maps absolute paths to the contents of the files at those paths.
+	overlay map[string][]byte
+}
+
+// newFileSystem returns a fileSystem reading files from fsys, or from disk if fsys is nil, with overlay
+// replacing the contents of files. Paths in overlay are made absolute.
+func newFileSystem(fsys fs.FS, overlay map[string][]byte) *fileSystem {
+	v := &fileSystem{fsys: fsys, overlay: map[string][]byte{}}
+	for p, b := range overlay {
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+		v.overlay[p] = b
+	}
+	return v
+}
+
+// name returns the name of the file at path in v.fsys.
+func (v *fileSystem) name(path string) string {
+	if n := strings.TrimPrefix(filepath.ToSlash(path), "/"); n != "" {
+		return n
+	}
+	return "."
+}
+
+func (v *fileSystem) ReadFile(path string) ([]byte, error) {
+	if b, ok := v.overlay[path]; ok {
+		return b, nil
+	}
+	if v.fsys == nil {
+		return ioutil.ReadFile(path)
+	}
+	return fs.ReadFile(v.fsys, v.name(path))
+}
+
+func (v *fileSystem) Stat(path string) (os.FileInfo, error) {
+	if b, ok := v.overlay[path]; ok {
+		return overlayInfo{name: filepath.Base(path), size: int64(len(b))}, nil
+	}
+	var info os.FileInfo
+	var err error
+	if v.fsys == nil {
+		info, err = os.Stat(path)
+	} else {
+		info, err = fs.Stat(v.fsys, v.name(path))
+	}
+	if os.IsNotExist(err) && v.overlayDir(path) {
+		return overlayInfo{name: filepath.Base(path), dir: true}, nil
+	}
+	return info, err
+}
+
+// overlayDir returns true if the overlay holds files in the directory tree rooted at dir.
+func (v *fileSystem) overlayDir(dir string) bool {
+	for p := range v.overlay {
+		if strings.HasPrefix(p, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadDir returns the entries of dir, including files in the overlay, sorted by name.
+func (v *fileSystem) ReadDir(dir string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	var err error
+	if v.fsys == nil {
+		infos, err = ioutil.ReadDir(dir)
+	} else {
+		var entries []fs.DirEntry
+		entries, err = fs.ReadDir(v.fsys, v.name(dir))
+		for _, e := range entries {
+			info, ierr := e.Info()
+			if ierr != nil {
+				return nil, ierr
+			}
+			infos = append(infos, info)
+		}
+	}
+	if err != nil && !(os.IsNotExist(err) && v.overlayDir(dir)) {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, i := range infos {
+		seen[i.Name()] = true
+	}
+	for p := range v.overlay {
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		n := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+		if seen[n[0]] {
+			continue
+		}
+		seen[n[0]] = true
+		info, err := v.Stat(filepath.Join(dir, n[0]))
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// Walk walks the file tree rooted at root like filepath.Walk.
+func (v *fileSystem) Walk(root string, fn filepath.WalkFunc) error {
+	info, err := v.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	if err := v.walk(root, info, fn); err != filepath.SkipDir {
+		return err
+	}
+	return nil
+}
+
+func (v *fileSystem) walk(path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+	if err := fn(path, info, nil); err != nil {
+		return err
+	}
+	infos, err := v.ReadDir(path)
+	if err != nil {
+		return fn(path, info, err)
+	}
+	for _, i := range infos {
+		if err := v.walk(filepath.Join(path, i.Name()), i, fn); err != nil && !(i.IsDir() && err == filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
+
+// setHooks makes ctx read files using v.
+func (v *fileSystem) setHooks(ctx *build.Context) {
+	ctx.OpenFile = func(path string) (io.ReadCloser, error) {
+		b, err := v.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	ctx.ReadDir = v.ReadDir
+	ctx.IsDir = func(path string) bool {
+		info, err := v.Stat(path)
+		return err == nil && info.IsDir()
+	}
+	if ctx.JoinPath == nil {
+		ctx.JoinPath = filepath.Join
+	}
+}
+
+// overlayInfo describes a file in an overlay, or a directory containing one.
+type overlayInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i overlayInfo) Name() string       { return i.name }
+func (i overlayInfo) Size() int64        { return i.size }
+func (i overlayInfo) ModTime() time.Time { return time.Time{} }
+func (i overlayInfo) IsDir() bool        { return i.dir }
+func (i overlayInfo) Sys() interface{}   { return nil }
+
+func (i overlayInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
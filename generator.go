@@ -0,0 +1,233 @@
+package stencil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/build"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Options configure how a Generator generates stencilled packages.
+type Options struct {
+	// OutputDir is the directory stencilled packages are generated in. If empty, they are generated in the directory
+	// selected by Output. Unless OutputDir is a vendor directory, imports of stencilled packages are rewritten to
+	// import the generated packages.
+	OutputDir string
+	// Output selects the directory stencilled packages are generated in if OutputDir is empty.
+	Output OutputMode
+	// Format runs goimports on the Go files in the processed paths after generating, including the files of
+	// packages matched by paths ending in /....
+	Format bool
+	// BuildContext is used to locate packages. If nil, go/build.Default is used.
+	BuildContext *build.Context
+	// Logger, if set, logs the files written or removed.
+	Logger Logger
+	// DryRun generates files without writing or removing any.
+	DryRun bool
+	// Tests specializes the tests of stencils along with the stencils. Stencils imported by test files in the
+	// processed paths are generated as well.
+	Tests bool
+	// Workers is the number of stencilled packages generated concurrently. If zero, GOMAXPROCS is used.
+	Workers int
+	// FailFast stops generating stencilled packages after the first error, instead of reporting the errors
+	// of all imports.
+	FailFast bool
+	// Writer writes generated files. If nil, files are written to disk.
+	Writer Writer
+	// FS, if set, holds the stencils and the packages importing them, instead of the disk. An absolute path
+	// refers to the file in FS at the path without the leading separator. Packages are located using
+	// GOPATH, or, in a module, only in the module, since the go command cannot read files in FS.
+	FS fs.FS
+	// Overlay maps file paths to contents replacing the contents of the files, such as the contents of unsaved
+	// editor buffers. Files in Overlay need not exist.
+	Overlay map[string][]byte
+	// Rename names each stencilled package after the types replacing its parameters, so that the package
+	// generated for std/slice/T/int is named intslice instead of slice, and replaces the names of the parameters
+	// in its comments with those types. Code importing a renamed package without naming the import refers
+	// to it by its new name.
+	Rename bool
+	// Permissive allows substituting types that are not marked as parameters, in stencils marking their
+	// parameters with a //stencil:param comment.
+	Permissive bool
+	// Specializations are stencilled packages to generate along with those imported by the processed paths.
+	// The command reads them from a stencil.yaml or stencil.json file, see FindConfig.
+	Specializations []Specialization
+	// Defaults maps the import paths of stencils to the types replacing their parameters when a stencilled
+	// import path does not substitute them, written as in import paths. They override the defaults given by
+	// //stencil:param comments.
+	Defaults map[string]map[string]string
+}
+
+// An OutputMode selects the directory stencilled packages are generated in.
+type OutputMode int
+
+const (
+	// DefaultOutput generates stencilled packages in the nearest vendor directory, or in the generated directory
+	// at the root of a module.
+	DefaultOutput OutputMode = iota
+	// NearestVendor generates stencilled packages in the nearest vendor directory containing the importing
+	// package, creating one in the importing package if there is none. It cannot be used in a module.
+	NearestVendor
+	// RootVendor generates stencilled packages in the vendor directory at the root of the repository containing
+	// the importing package. It cannot be used in a module.
+	RootVendor
+	// GeneratedDir generates stencilled packages in the generated directory at the root of the repository or
+	// module containing the importing package. Imports of stencilled packages are rewritten to import them.
+	GeneratedDir
+)
+
+var outputModes = []string{
+	DefaultOutput: "default",
+	NearestVendor: "vendor",
+	RootVendor:    "root-vendor",
+	GeneratedDir:  "generated",
+}
+
+func (m OutputMode) String() string {
+	if m < 0 || int(m) >= len(outputModes) {
+		return fmt.Sprintf("OutputMode(%d)", int(m))
+	}
+	return outputModes[m]
+}
+
+// ParseOutputMode returns the OutputMode named s, one of default, vendor, root-vendor or generated.
+func ParseOutputMode(s string) (OutputMode, error) {
+	for m, n := range outputModes {
+		if n == s {
+			return OutputMode(m), nil
+		}
+	}
+	return DefaultOutput, errors.Errorf("unknown output mode %q", s)
+}
+
+// A Logger logs messages. It is implemented by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// A Writer writes generated files.
+type Writer interface {
+	// WriteFile writes data to the file at path, creating any directories needed.
+	WriteFile(path string, data []byte) error
+}
+
+// diskWriter writes files to disk, keeping the mode of existing files.
+type diskWriter struct{}
+
+func (diskWriter) WriteFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	mode := os.FileMode(0644)
+	if s, err := os.Stat(path); err == nil {
+		mode = s.Mode()
+	}
+	return errors.WithStack(ioutil.WriteFile(path, data, mode))
+}
+
+// Generator generates stencilled packages.
+type Generator struct {
+	opts Options
+}
+
+// NewGenerator returns a Generator configured by opts.
+func NewGenerator(opts Options) *Generator {
+	return &Generator{opts: opts}
+}
+
+func (g *Generator) options() options {
+	return options{
+		tests:        g.opts.Tests,
+		workers:      g.opts.Workers,
+		failFast:     g.opts.FailFast,
+		outputDir:    g.opts.OutputDir,
+		output:       g.opts.Output,
+		buildContext: g.opts.BuildContext,
+		fs:           newFileSystem(g.opts.FS, g.opts.Overlay),
+		rename:       g.opts.Rename,
+		permissive:   g.opts.Permissive,
+		specs:        g.opts.Specializations,
+		names:        packageNames(g.opts.Specializations),
+		defaults:     defaultReplacers(g.opts.Defaults),
+	}
+}
+
+func (g *Generator) writer() Writer {
+	if g.opts.Writer == nil {
+		return diskWriter{}
+	}
+	return g.opts.Writer
+}
+
+func (g *Generator) logf(format string, v ...interface{}) {
+	if g.opts.Logger != nil {
+		g.opts.Logger.Printf(format, v...)
+	}
+}
+
+// Generate returns the files generated for the stencilled packages imported by paths, along with the files in
+// paths with rewritten imports, without writing them. Every stencilled package is generated, even if up to date.
+func (g *Generator) Generate(ctx context.Context, paths []string) ([]File, error) {
+	return processStencil(ctx, paths, g.options())
+}
+
+// Process generates the stencilled packages imported by paths and writes them, returning the files written.
+// Stencilled packages whose provenance shows they are up to date are not generated again, and files on disk
+// are only written if their contents change. If DryRun is set, the files are returned without being written.
+func (g *Generator) Process(ctx context.Context, paths []string) ([]File, error) {
+	opts := g.options()
+	opts.cache = true
+	files, err := processStencil(ctx, paths, opts)
+	if err != nil {
+		return nil, err
+	}
+	written, err := g.write(opts.fs, files)
+	if err != nil || !g.opts.Format || g.opts.DryRun {
+		return written, err
+	}
+	return written, doImports(opts.fs, paths, opts.tests, g.writer())
+}
+
+// Migrate converts the stencil with the import path stencil into a package using type parameters, and rewrites
+// the Go files in paths that import stencilled packages of the stencil to import the converted package instead,
+// instantiating its generic functions and types with the types that replaced the parameters. The files of the
+// stencil are replaced. It returns the files written. If DryRun is set, the files are returned without being written.
+//
+// Stencils with tests, and stencils outside the main module or a GOPATH workspace, are not migrated.
+// Stencilled packages are left in place, to be removed using Clean once nothing imports them.
+func (g *Generator) Migrate(ctx context.Context, stencil string, paths []string) ([]File, error) {
+	opts := g.options()
+	files, err := migrate(ctx, stencil, paths, opts)
+	if err != nil {
+		return nil, err
+	}
+	return g.write(opts.fs, files)
+}
+
+// write writes the files whose contents differ from the files read from v, returning them. If DryRun is set,
+// the files are returned without being written.
+func (g *Generator) write(v *fileSystem, files []File) ([]File, error) {
+	w := g.writer()
+	var written []File
+	for _, f := range files {
+		// Leave unchanged files alone, so that their modification times are preserved.
+		if b, err := v.ReadFile(f.Path); err == nil && bytes.Equal(b, f.Data) {
+			continue
+		}
+		written = append(written, f)
+		if g.opts.DryRun {
+			continue
+		}
+		if err := w.WriteFile(f.Path, f.Data); err != nil {
+			return nil, err
+		}
+		g.logf("wrote %s", f.Path)
+	}
+	return written, nil
+}
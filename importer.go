@@ -0,0 +1,134 @@
+package stencil
+
+import (
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// sourceImporter type checks imported packages from source, locating them using a build context.
+// Unlike the "source" importer in go/importer, it can resolve packages in a module other than the
+// one in the working directory.
+// It may be used concurrently.
+type sourceImporter struct {
+	ctx   *build.Context
+	fs    *token.FileSet
+	files *fileSystem
+	mu    sync.Mutex
+	pkgs  map[string]*types.Package
+}
+
+// newSourceImporter returns an importer locating packages using ctx and reading them from files.
+func newSourceImporter(ctx *build.Context, fs *token.FileSet, files *fileSystem) *sourceImporter {
+	return &sourceImporter{ctx: ctx, fs: fs, files: files, pkgs: map[string]*types.Package{}}
+}
+
+func (i *sourceImporter) Import(path string) (*types.Package, error) {
+	return i.ImportFrom(path, "", 0)
+}
+
+func (i *sourceImporter) ImportFrom(path, dir string, _ types.ImportMode) (*types.Package, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.importFrom(path, dir)
+}
+
+// importFrom imports path with i.mu held.
+func (i *sourceImporter) importFrom(path, dir string) (*types.Package, error) {
+	if path == "unsafe" {
+		return types.Unsafe, nil
+	}
+	bp, err := i.ctx.Import(path, dir, 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if pkg, ok := i.pkgs[bp.ImportPath]; ok {
+		if pkg == nil {
+			return nil, errors.Errorf("%s: import cycle", bp.ImportPath)
+		}
+		return pkg, nil
+	}
+	i.pkgs[bp.ImportPath] = nil
+
+	var files []*ast.File
+	for _, n := range append(bp.GoFiles, bp.CgoFiles...) {
+		p := filepath.Join(bp.Dir, n)
+		b, err := i.files.ReadFile(p)
+		if err != nil {
+			delete(i.pkgs, bp.ImportPath)
+			return nil, errors.WithStack(err)
+		}
+		f, err := parser.ParseFile(i.fs, p, b, 0)
+		if err != nil {
+			delete(i.pkgs, bp.ImportPath)
+			return nil, errors.WithStack(err)
+		}
+		files = append(files, f)
+	}
+	conf := types.Config{
+		Importer:    lockedImporter{i},
+		Error:       func(error) {},
+		FakeImportC: true,
+	}
+	pkg, _ := conf.Check(bp.ImportPath, i.fs, files, nil)
+	i.pkgs[bp.ImportPath] = pkg
+	return pkg, nil
+}
+
+// lockedImporter imports packages imported by packages being imported by a sourceImporter, with its lock held.
+type lockedImporter struct {
+	i *sourceImporter
+}
+
+func (l lockedImporter) Import(path string) (*types.Package, error) {
+	return l.i.importFrom(path, "")
+}
+
+func (l lockedImporter) ImportFrom(path, dir string, _ types.ImportMode) (*types.Package, error) {
+	return l.i.importFrom(path, dir)
+}
+
+// stencilImporter imports the type checked stencil pkg for the import path of the stencil, so that objects in
+// the external tests of a stencil are the objects being replaced.
+type stencilImporter struct {
+	path string
+	pkg  *types.Package
+	*sourceImporter
+}
+
+func (i *stencilImporter) Import(path string) (*types.Package, error) {
+	return i.ImportFrom(path, "", 0)
+}
+
+func (i *stencilImporter) ImportFrom(path, dir string, mode types.ImportMode) (*types.Package, error) {
+	if path == i.path && i.pkg != nil {
+		return i.pkg, nil
+	}
+	return i.sourceImporter.ImportFrom(path, dir, mode)
+}
+
+// specializedImporter imports the stencilled packages imported by a stencil as the stencils they specialize.
+// Stencilled packages may not have been generated yet, and the type checker would otherwise declare them
+// using the last element of their import path, which can shadow the types of the stencil.
+type specializedImporter struct {
+	g *generator
+}
+
+func (i specializedImporter) Import(path string) (*types.Package, error) {
+	return i.ImportFrom(path, "", 0)
+}
+
+func (i specializedImporter) ImportFrom(path, dir string, mode types.ImportMode) (*types.Package, error) {
+	if spath, ok := i.g.l.stencil(path); ok {
+		if _, base, _, err := replacements(i.g.l.exists, spath); err == nil && base != "" {
+			path = base
+		}
+	}
+	return i.g.imp.ImportFrom(path, dir, mode)
+}
@@ -0,0 +1,268 @@
+package stencil
+
+import (
+	"context"
+	"go/parser"
+	"go/token"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// job is a stencilled package to generate, along with the imports requesting it.
+type job struct {
+	g *generator
+	// dir is the directory of the first package importing the stencilled package.
+	dir string
+	// spath is the stencilled import path of the package.
+	spath string
+	// target is the directory the package is generated in and importPath is the import path of the generated package.
+	target, importPath string
+	// key identifies the stencil and substitutions the package is generated from.
+	key  string
+	refs []ref
+}
+
+// ref is an import of a stencilled package, or a specialization requesting it if spec is true.
+type ref struct {
+	pos  token.Position
+	path string
+	spec bool
+}
+
+// jobKey identifies the stencil in the directory stencil specialized using r.
+func jobKey(stencil string, r replacer) string {
+	keys := make([]string, 0, len(r))
+	for k := range r {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	subs := make([]string, len(keys))
+	for i, k := range keys {
+		subs[i] = k + "=" + r[k]
+	}
+	return stencil + ":" + strings.Join(subs, ",")
+}
+
+// conflictError is the error for the different stencilled packages a and b, both generated in target.
+func conflictError(target, a, b string) error {
+	return errors.Errorf("conflicting stencilled packages %s and %s are both generated in %s", a, b, target)
+}
+
+// collectJobs returns the stencilled packages imported by the files in dirs, in the order they are first imported,
+// followed by the packages in opts.specs. Each package is returned once no matter how many files import it. Packages sharing
+// an output directory share a generator, which deduplicates the stencilled packages they import in turn.
+// Imports of different stencilled packages that would be generated in the same directory are returned as Errors.
+func collectJobs(dirs map[string][]string, opts options) ([]*job, Errors, error) {
+	names := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+
+	var jobs []*job
+	// targets holds jobs keyed by the directory they are generated in.
+	targets := map[string]*job{}
+	gens := map[string]*generator{}
+	var errs Errors
+	// add adds a job for the import of path at rf, by the package in dir using the layout l.
+	add := func(l layout, dir, path string, rf ref) {
+		spath, ok := l.stencil(path)
+		if !ok {
+			return
+		}
+		stencil, _, r, err := replacements(l.exists, spath)
+		if err != nil {
+			errs = append(errs, &Error{Pos: rf.pos, Import: path, Err: err})
+			return
+		}
+		if stencil == "" {
+			return
+		}
+		g, ok := gens[l.outputDir()]
+		if !ok {
+			g = newGenerator(l, newSourceImporter(l.context(), token.NewFileSet(), opts.fs), dir, opts)
+			gens[l.outputDir()] = g
+		}
+		target, importPath := l.target(spath)
+		key := jobKey(stencil, r)
+		j, ok := targets[target]
+		if !ok {
+			j = &job{g: g, dir: dir, spath: spath, target: target, importPath: importPath, key: key, refs: []ref{rf}}
+			targets[target] = j
+			jobs = append(jobs, j)
+			return
+		}
+		if j.key != key {
+			err := conflictError(target, j.spath, spath)
+			errs = append(errs, &Error{Pos: rf.pos, Import: path, Err: err})
+			return
+		}
+		j.refs = append(j.refs, rf)
+	}
+
+	fs := token.NewFileSet()
+	for _, dir := range names {
+		l, err := newLayout(dir, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, fl := range dirs[dir] {
+			b, err := opts.fs.ReadFile(fl)
+			if err != nil {
+				return nil, nil, errors.WithStack(err)
+			}
+			f, err := parser.ParseFile(fs, fl, b, parser.ImportsOnly)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "%s: parse failed", fl)
+			}
+			for _, imp := range f.Imports {
+				path := imp.Path.Value
+				path = path[1 : len(path)-1]
+				add(l, dir, path, ref{pos: fs.Position(imp.Pos()), path: path})
+			}
+		}
+	}
+	for _, s := range opts.specs {
+		l, dir, err := specLayout(s, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		path := s.path()
+		// Specializations are not imported, so imports of them are not rewritten.
+		add(l, dir, path, ref{pos: token.Position{Filename: s.file}, path: path, spec: true})
+	}
+	return jobs, errs, nil
+}
+
+// specLayout returns the layout and the directory of the importing package for the specialization s.
+func specLayout(s Specialization, opts options) (layout, string, error) {
+	dir := s.Dir
+	if dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, "", errors.WithStack(err)
+		}
+		dir = wd
+	}
+	if s.Output != "" {
+		opts.output, opts.outputDir = parseOutput(s.Output, dir)
+	}
+	l, err := newLayout(dir, opts)
+	return l, dir, err
+}
+
+// runJobs generates jobs concurrently, using opts.workers goroutines. Errors generating a job are returned for
+// every import of it. If opts.failFast is true, no jobs are started after the first error. If ctx is cancelled,
+// generation stops and the error of ctx is returned.
+func runJobs(ctx context.Context, jobs []*job, opts options) (Errors, error) {
+	workers := opts.workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	gctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jerrs := make([]error, len(jobs))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				j := jobs[i]
+				if _, _, jerrs[i] = j.g.fork(gctx, j.dir).generate(j.spath); jerrs[i] != nil && opts.failFast {
+					cancel()
+				}
+			}
+		}()
+	}
+feed:
+	for i := range jobs {
+		select {
+		case work <- i:
+		case <-gctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var errs Errors
+	for i, err := range jerrs {
+		// Jobs cancelled after an earlier error are not reported.
+		if err == nil || errors.Cause(err) == context.Canceled {
+			continue
+		}
+		for _, ref := range jobs[i].refs {
+			errs = append(errs, &Error{Pos: ref.pos, Import: ref.path, Err: err})
+		}
+	}
+	return errs, nil
+}
+
+// generated is a stencilled package that has been generated.
+type generated struct {
+	// spath is the stencilled import path of the package.
+	spath string
+	// key identifies the stencil and substitutions the package was generated from.
+	key string
+	// name is the package name of the stencil.
+	name string
+	// files holds the generated files. It is empty if the package was up to date.
+	files []File
+	// deps holds the directories of the stencilled packages imported by the package.
+	deps []string
+}
+
+// registry holds generated stencilled packages, keyed by the directory they are generated in.
+type registry struct {
+	mu   sync.Mutex
+	pkgs map[string]*generated
+}
+
+func newRegistry() *registry {
+	return &registry{pkgs: map[string]*generated{}}
+}
+
+func (r *registry) get(target string) (*generated, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.pkgs[target]
+	return p, ok
+}
+
+// add adds p, generated in target, and returns it. If another package was added for target first, as can
+// happen when generating concurrently, the package added first is returned instead.
+func (r *registry) add(target string, p *generated) *generated {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d, ok := r.pkgs[target]; ok {
+		return d
+	}
+	r.pkgs[target] = p
+	return p
+}
+
+// files appends the files of the package generated in target to res, preceded by the files of the stencilled
+// packages it imports. Packages in seen are skipped, so the order of files does not depend on which
+// package was generated first.
+func (r *registry) files(target string, seen map[string]bool, res *[]File) {
+	p, ok := r.get(target)
+	if !ok || seen[target] {
+		return
+	}
+	seen[target] = true
+	for _, d := range p.deps {
+		r.files(d, seen, res)
+	}
+	*res = append(*res, p.files...)
+}
@@ -0,0 +1,1047 @@
+package stencil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/imports"
+)
+
+// constraint is the constraint of a type parameter, inferred from the operations a stencil applies to values of
+// the parameter it replaces. Each constraint allows the operations allowed by the constraints before it.
+type constraint int
+
+const (
+	anyConstraint constraint = iota
+	comparableConstraint
+	orderedConstraint
+	numberConstraint
+	integerConstraint
+)
+
+// declaredConstraint is a constraint declared in the migrated packages that need it.
+type declaredConstraint struct {
+	name, doc, types string
+}
+
+var declaredConstraints = map[constraint]declaredConstraint{
+	numberConstraint: {
+		name:  "number",
+		doc:   "number is the constraint of type parameters used in arithmetic.",
+		types: "~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr | ~float32 | ~float64",
+	},
+	integerConstraint: {
+		name:  "integer",
+		doc:   "integer is the constraint of type parameters used in integer arithmetic.",
+		types: "~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr",
+	},
+}
+
+// opConstraints are the constraints needed by the operands of binary operators.
+var opConstraints = map[token.Token]constraint{
+	token.EQL:     comparableConstraint,
+	token.NEQ:     comparableConstraint,
+	token.LSS:     orderedConstraint,
+	token.LEQ:     orderedConstraint,
+	token.GTR:     orderedConstraint,
+	token.GEQ:     orderedConstraint,
+	token.ADD:     orderedConstraint,
+	token.SUB:     numberConstraint,
+	token.MUL:     numberConstraint,
+	token.QUO:     numberConstraint,
+	token.REM:     integerConstraint,
+	token.AND:     integerConstraint,
+	token.OR:      integerConstraint,
+	token.XOR:     integerConstraint,
+	token.AND_NOT: integerConstraint,
+	token.SHL:     integerConstraint,
+	token.SHR:     integerConstraint,
+}
+
+// migration converts a type checked stencil into a package using type parameters.
+type migration struct {
+	fs    *token.FileSet
+	pkg   *types.Package
+	info  *types.Info
+	files map[string]*ast.File
+	// params are the parameters of the stencil, in the order they are declared.
+	params []*types.TypeName
+	// specs are the declarations of the parameters.
+	specs map[*types.TypeName]*ast.TypeSpec
+	// natural are the types declared for the parameters, used as the type arguments of parameters that are
+	// neither substituted nor have a default.
+	natural map[*types.TypeName]string
+	// defaults are the defaults of the parameters that have one.
+	defaults replacer
+	// ifaces are the methods of the interfaces declared for parameters with methods, which constrain them.
+	ifaces map[*types.TypeName][]string
+	// decls maps the package level objects of the stencil to their declarations.
+	decls map[types.Object][]ast.Node
+	// refs maps package level objects to the package level objects their declarations refer to.
+	refs map[types.Object][]types.Object
+	// generic maps the package level declarations mentioning parameters, directly or through other declarations,
+	// to the parameters they take, in order.
+	generic map[types.Object][]*types.TypeName
+	// constraints maps generic declarations to the constraints of their type parameters, inferred from the
+	// operations they apply to values of the parameters and the constraints of the declarations they refer to.
+	constraints map[types.Object]map[*types.TypeName]constraint
+	// cmp is set when a type parameter constrained by cmp.Ordered is declared in the file being migrated.
+	cmp bool
+}
+
+// newMigration returns the migration of the stencil pkg, type checked with the type information info. The parameters
+// of the stencil are the types marked with //stencil:param, or, if there are none, the interfaces it declares.
+func newMigration(fs *token.FileSet, pkg *types.Package, info *types.Info, files map[string]*ast.File) (*migration, error) {
+	names, defaults, err := stencilParams(files)
+	if err != nil {
+		return nil, err
+	}
+	m := &migration{
+		fs:          fs,
+		pkg:         pkg,
+		info:        info,
+		files:       files,
+		specs:       map[*types.TypeName]*ast.TypeSpec{},
+		natural:     map[*types.TypeName]string{},
+		defaults:    defaults,
+		ifaces:      map[*types.TypeName][]string{},
+		refs:        map[types.Object][]types.Object{},
+		generic:     map[types.Object][]*types.TypeName{},
+		constraints: map[types.Object]map[*types.TypeName]constraint{},
+	}
+	for _, f := range files {
+		for _, d := range f.Decls {
+			g, ok := d.(*ast.GenDecl)
+			if !ok || g.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range g.Specs {
+				t := spec.(*ast.TypeSpec)
+				tn, ok := info.Defs[t.Name].(*types.TypeName)
+				if !ok || names != nil && !contains(names, tn.Name()) || names == nil && !isInterface(t.Type) {
+					continue
+				}
+				m.params = append(m.params, tn)
+				m.specs[tn] = t
+				if m.natural[tn], err = m.print(t.Type); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if len(m.params) == 0 {
+		return nil, errors.New("no parameters to migrate: mark them with //stencil:param")
+	}
+	sort.Slice(m.params, func(i, j int) bool { return m.params[i].Pos() < m.params[j].Pos() })
+	if err := m.findGeneric(); err != nil {
+		return nil, err
+	}
+	return m, m.inferConstraints()
+}
+
+// isInterface returns true if e is an interface type.
+func isInterface(e ast.Expr) bool {
+	_, ok := e.(*ast.InterfaceType)
+	return ok
+}
+
+// print returns the source of n.
+func (m *migration) print(n ast.Node) (string, error) {
+	var b bytes.Buffer
+	if err := format.Node(&b, m.fs, n); err != nil {
+		return "", errors.Wrapf(err, "%s: failed to print", m.fs.Position(n.Pos()))
+	}
+	return b.String(), nil
+}
+
+// declarations returns the package level objects of the stencil and the declarations defining them. The methods
+// of a type are part of its declaration.
+func (m *migration) declarations() map[types.Object][]ast.Node {
+	decls := map[types.Object][]ast.Node{}
+	add := func(obj types.Object, n ast.Node) {
+		if obj != nil && obj.Name() != "_" {
+			decls[obj] = append(decls[obj], n)
+		}
+	}
+	for _, p := range sortedPaths(m.files) {
+		for _, d := range m.files[p].Decls {
+			switch d := d.(type) {
+			case *ast.FuncDecl:
+				if d.Recv == nil {
+					add(m.info.Defs[d.Name], d)
+				} else if id := recvTypeName(d.Recv); id != nil {
+					add(m.info.Uses[id], d)
+				}
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						add(m.info.Defs[spec.Name], spec)
+					case *ast.ValueSpec:
+						for _, n := range spec.Names {
+							add(m.info.Defs[n], spec)
+						}
+					}
+				}
+			}
+		}
+	}
+	return decls
+}
+
+// recvTypeName returns the name of the type of the receiver recv, if any.
+func recvTypeName(recv *ast.FieldList) *ast.Ident {
+	if len(recv.List) != 1 {
+		return nil
+	}
+	t := recv.List[0].Type
+	if s, ok := t.(*ast.StarExpr); ok {
+		t = s.X
+	}
+	id, _ := ast.Unparen(t).(*ast.Ident)
+	return id
+}
+
+// findGeneric finds the declarations that take type parameters, because they mention parameters of the stencil
+// or other declarations that do.
+func (m *migration) findGeneric() error {
+	scope := m.pkg.Scope()
+	m.decls = m.declarations()
+	for obj, nodes := range m.decls {
+		for _, n := range nodes {
+			ast.Inspect(n, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Ident); ok {
+					if u := m.info.Uses[id]; u != nil && u != obj && scope.Lookup(u.Name()) == u {
+						m.refs[obj] = append(m.refs[obj], u)
+					}
+				}
+				return true
+			})
+		}
+	}
+	needs := map[types.Object]map[*types.TypeName]bool{}
+	for _, p := range m.params {
+		needs[p] = map[*types.TypeName]bool{p: true}
+	}
+	for changed := true; changed; {
+		changed = false
+		for obj, rs := range m.refs {
+			for _, r := range rs {
+				for p := range needs[r] {
+					if needs[obj] == nil {
+						needs[obj] = map[*types.TypeName]bool{}
+					}
+					if !needs[obj][p] {
+						needs[obj][p], changed = true, true
+					}
+				}
+			}
+		}
+	}
+	for obj, ps := range needs {
+		if tn, ok := obj.(*types.TypeName); ok && m.specs[tn] != nil {
+			continue
+		}
+		for _, p := range m.params {
+			if ps[p] {
+				m.generic[obj] = append(m.generic[obj], p)
+			}
+		}
+	}
+	return m.checkGeneric()
+}
+
+// sortedGeneric returns the generic declarations in the order they are declared.
+func (m *migration) sortedGeneric() []types.Object {
+	objs := make([]types.Object, 0, len(m.generic))
+	for obj := range m.generic {
+		objs = append(objs, obj)
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Pos() < objs[j].Pos() })
+	return objs
+}
+
+// paramNames returns the names of ps, separated by commas.
+func paramNames(ps []*types.TypeName) string {
+	names := make([]string, len(ps))
+	for i, p := range ps {
+		names[i] = p.Name()
+	}
+	return strings.Join(names, ", ")
+}
+
+// checkGeneric returns an error for generic declarations that cannot take type parameters. Variables become
+// functions returning their initial value, so they cannot be assigned to.
+func (m *migration) checkGeneric() error {
+	for _, obj := range m.sortedGeneric() {
+		ps, pos := paramNames(m.generic[obj]), m.fs.Position(obj.Pos())
+		switch obj := obj.(type) {
+		case *types.Const:
+			return errors.Errorf("%s: constant %s depends on %s and cannot be migrated", pos, obj.Name(), ps)
+		case *types.Func:
+			if obj.Name() == "init" || obj.Name() == "main" {
+				return errors.Errorf("%s: function %s depends on %s and cannot be migrated", pos, obj.Name(), ps)
+			}
+		case *types.Var:
+			if spec := m.decls[obj][0].(*ast.ValueSpec); len(spec.Names) > 1 {
+				return errors.Errorf("%s: variable %s depends on %s and is declared along with other variables", pos, obj.Name(), ps)
+			}
+		}
+	}
+
+	var err error
+	assigned := func(e ast.Expr) {
+		id, ok := ast.Unparen(e).(*ast.Ident)
+		if !ok || err != nil {
+			return
+		}
+		if v, ok := m.info.Uses[id].(*types.Var); ok && m.generic[v] != nil {
+			err = errors.Errorf("%s: variable %s depends on %s and is assigned, so it cannot be migrated",
+				m.fs.Position(id.Pos()), v.Name(), paramNames(m.generic[v]))
+		}
+	}
+	for _, p := range sortedPaths(m.files) {
+		ast.Inspect(m.files[p], func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.AssignStmt:
+				for _, l := range n.Lhs {
+					assigned(l)
+				}
+			case *ast.IncDecStmt:
+				assigned(n.X)
+			case *ast.RangeStmt:
+				if n.Tok == token.ASSIGN {
+					assigned(n.Key)
+					if n.Value != nil {
+						assigned(n.Value)
+					}
+				}
+			case *ast.UnaryExpr:
+				if n.Op == token.AND {
+					assigned(n.X)
+				}
+			}
+			return err == nil
+		})
+	}
+	return err
+}
+
+// paramOf returns the parameter t is, if any.
+func (m *migration) paramOf(t types.Type) *types.TypeName {
+	if t == nil {
+		return nil
+	}
+	for _, p := range m.params {
+		if types.Identical(t, p.Type()) {
+			return p
+		}
+	}
+	return nil
+}
+
+// need records that the declaration of obj needs at least the constraint c for the parameter t, if t is one.
+func (m *migration) need(obj types.Object, t types.Type, c constraint) {
+	if p := m.paramOf(t); p != nil && m.constraints[obj][p] < c {
+		m.constraints[obj][p] = c
+	}
+}
+
+// inferConstraints infers the constraints of the type parameters of generic declarations.
+func (m *migration) inferConstraints() error {
+	for _, obj := range m.sortedGeneric() {
+		m.constraints[obj] = map[*types.TypeName]constraint{}
+		for _, n := range m.decls[obj] {
+			var err error
+			ast.Inspect(n, func(n ast.Node) bool {
+				if e, ok := n.(ast.Expr); ok && err == nil {
+					err = m.inferConstant(obj, e)
+				}
+				m.inferOp(obj, n)
+				return err == nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// Declarations need the constraints of the declarations they refer to.
+	for changed := true; changed; {
+		changed = false
+		for obj, cs := range m.constraints {
+			for _, r := range m.refs[obj] {
+				for p, c := range m.constraints[r] {
+					if cs[p] < c {
+						cs[p], changed = c, true
+					}
+				}
+			}
+		}
+	}
+	for obj, cs := range m.constraints {
+		for p, c := range cs {
+			if d, ok := declaredConstraints[c]; ok && m.pkg.Scope().Lookup(d.name) != nil {
+				return errors.Errorf("%s: the constraint of %s in %s cannot be declared, since the stencil declares %s",
+					m.fs.Position(obj.Pos()), p.Name(), obj.Name(), d.name)
+			}
+		}
+	}
+	return nil
+}
+
+// inferOp records the constraints needed by the declaration of obj for the operation n.
+func (m *migration) inferOp(obj types.Object, n ast.Node) {
+	switch n := n.(type) {
+	case *ast.BinaryExpr:
+		m.need(obj, m.info.TypeOf(n.X), opConstraints[n.Op])
+		m.need(obj, m.info.TypeOf(n.Y), opConstraints[n.Op])
+	case *ast.AssignStmt:
+		if n.Tok >= token.ADD_ASSIGN && n.Tok <= token.AND_NOT_ASSIGN {
+			m.need(obj, m.info.TypeOf(n.Lhs[0]), opConstraints[n.Tok-token.ADD_ASSIGN+token.ADD])
+		}
+	case *ast.IncDecStmt:
+		m.need(obj, m.info.TypeOf(n.X), numberConstraint)
+	case *ast.UnaryExpr:
+		switch n.Op {
+		case token.SUB, token.ADD:
+			m.need(obj, m.info.TypeOf(n.X), numberConstraint)
+		case token.XOR:
+			m.need(obj, m.info.TypeOf(n.X), integerConstraint)
+		}
+	case *ast.MapType:
+		m.need(obj, m.info.TypeOf(n.Key), comparableConstraint)
+	case *ast.SwitchStmt:
+		if n.Tag != nil {
+			m.need(obj, m.info.TypeOf(n.Tag), comparableConstraint)
+		}
+	case *ast.CallExpr:
+		// Conversions between a parameter and other types that are not interfaces are numeric conversions.
+		if tv, ok := m.info.Types[n.Fun]; ok && tv.IsType() && len(n.Args) == 1 {
+			from, to := m.info.TypeOf(n.Args[0]), tv.Type
+			if from != nil && !types.Identical(from, to) && !types.IsInterface(from) && !types.IsInterface(to) {
+				m.need(obj, from, numberConstraint)
+				m.need(obj, to, numberConstraint)
+			}
+		}
+	}
+}
+
+// inferConstant records the constraint needed by the declaration of obj if e is a constant value of a
+// parameter, returning an error if no constraint allows it.
+func (m *migration) inferConstant(obj types.Object, e ast.Expr) error {
+	tv, ok := m.info.Types[e]
+	p := m.paramOf(tv.Type)
+	if !ok || p == nil || tv.Value == nil && !tv.IsNil() {
+		return nil
+	}
+	switch {
+	case tv.IsNil():
+		return errors.Errorf("%s: nil is used as a value of %s, which a type parameter cannot be", m.fs.Position(e.Pos()), p.Name())
+	case tv.Value.Kind() == constant.Int || tv.Value.Kind() == constant.Float:
+		m.need(obj, tv.Type, numberConstraint)
+		return nil
+	}
+	return errors.Errorf("%s: the constant %s is used as a value of %s, which no constraint allows",
+		m.fs.Position(e.Pos()), tv.Value, p.Name())
+}
+
+// bound returns the constraint of the type parameter p of the declaration of obj.
+func (m *migration) bound(obj types.Object, p *types.TypeName) string {
+	c := m.constraints[obj][p]
+	b := "any"
+	switch c {
+	case comparableConstraint:
+		b = "comparable"
+	case orderedConstraint:
+		b = "cmp.Ordered"
+	case numberConstraint, integerConstraint:
+		b = declaredConstraints[c].name
+	}
+	methods, ok := m.ifaces[p]
+	if !ok {
+		return b
+	}
+	// Parameters with methods are constrained by their interfaces, embedding any inferred constraint.
+	if c != anyConstraint {
+		methods = append([]string{b}, methods...)
+	}
+	return "interface{ " + strings.Join(methods, "; ") + " }"
+}
+
+// typeParams returns the type parameter list of the declaration of obj.
+func (m *migration) typeParams(obj types.Object) *ast.FieldList {
+	fl := &ast.FieldList{}
+	for _, p := range m.generic[obj] {
+		b := m.bound(obj, p)
+		m.cmp = m.cmp || strings.Contains(b, "cmp.Ordered")
+		if n := len(fl.List); n > 0 && fl.List[n-1].Type.(*ast.Ident).Name == b {
+			fl.List[n-1].Names = append(fl.List[n-1].Names, ast.NewIdent(p.Name()))
+			continue
+		}
+		fl.List = append(fl.List, &ast.Field{Names: []*ast.Ident{ast.NewIdent(p.Name())}, Type: ast.NewIdent(b)})
+	}
+	return fl
+}
+
+// instantiation returns x instantiated with args, called if obj is a variable, which migrated packages
+// declare as a function returning its value.
+func instantiation(obj types.Object, x ast.Expr, args []ast.Expr) ast.Expr {
+	if len(args) == 1 {
+		x = &ast.IndexExpr{X: x, Index: args[0]}
+	} else {
+		x = &ast.IndexListExpr{X: x, Indices: args}
+	}
+	if _, ok := obj.(*types.Var); ok {
+		x = &ast.CallExpr{Fun: x}
+	}
+	return x
+}
+
+// instantiate instantiates references to generic declarations in the stencil with the parameters they take.
+func (m *migration) instantiate(c *astutil.Cursor) bool {
+	id, ok := c.Node().(*ast.Ident)
+	if !ok {
+		return true
+	}
+	obj := m.info.Uses[id]
+	ps, ok := m.generic[obj]
+	if !ok {
+		return true
+	}
+	args := make([]ast.Expr, len(ps))
+	for i, p := range ps {
+		args[i] = ast.NewIdent(p.Name())
+	}
+	c.Replace(instantiation(obj, &ast.Ident{Name: id.Name, NamePos: id.NamePos}, args))
+	return true
+}
+
+// typeIdent matches the identifiers in type strings, along with the dot preceding qualified identifiers.
+var typeIdent = regexp.MustCompile(`\.?[\pL_][\pL\pN_]*`)
+
+// typeString returns t, a type used in the stencil, as written in the migrated package.
+func (m *migration) typeString(t types.Type) string {
+	s := types.TypeString(t, func(p *types.Package) string {
+		if p == m.pkg {
+			return ""
+		}
+		return p.Name()
+	})
+	return typeIdent.ReplaceAllStringFunc(s, func(id string) string {
+		obj := m.pkg.Scope().Lookup(id)
+		if _, ok := obj.(*types.TypeName); !ok || m.generic[obj] == nil {
+			return id
+		}
+		return id + "[" + paramNames(m.generic[obj]) + "]"
+	})
+}
+
+// funcHeader returns the header of the function replacing the generic package level variable declared by spec.
+func (m *migration) funcHeader(spec *ast.ValueSpec) (string, error) {
+	obj := m.info.Defs[spec.Names[0]]
+	typ := m.typeString(obj.Type())
+	if spec.Type != nil {
+		var err error
+		if typ, err = m.print(spec.Type); err != nil {
+			return "", err
+		}
+	}
+	var tparams []string
+	for _, f := range m.typeParams(obj).List {
+		names := make([]string, len(f.Names))
+		for i, n := range f.Names {
+			names[i] = n.Name
+		}
+		tparams = append(tparams, strings.Join(names, ", ")+" "+f.Type.(*ast.Ident).Name)
+	}
+	return fmt.Sprintf("func %s[%s]() %s", obj.Name(), strings.Join(tparams, ", "), typ), nil
+}
+
+// varFuncs replaces the declarations of generic package level variables in src, a migrated file, with functions
+// returning the values the variables are initialized to. funcs maps the names of the variables to the headers of
+// the functions. The functions are written as source, so that the comments of the variables stay in place.
+func varFuncs(src []byte, funcs map[string]string) ([]byte, error) {
+	if len(funcs) == 0 {
+		return src, nil
+	}
+	fs := token.NewFileSet()
+	f, err := parser.ParseFile(fs, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var edits []edit
+	off := func(p token.Pos) int { return fs.Position(p).Offset }
+	// line returns the offsets of the lines from start to end, including the final newline.
+	line := func(start, end token.Pos) (int, int) {
+		s, e := off(start), off(end)
+		s = bytes.LastIndexByte(src[:s], '\n') + 1
+		if i := bytes.IndexByte(src[e:], '\n'); i >= 0 {
+			e += i + 1
+		}
+		return s, e
+	}
+	for _, d := range f.Decls {
+		g, ok := d.(*ast.GenDecl)
+		if !ok || g.Tok != token.VAR {
+			continue
+		}
+		var texts []string
+		var removed []edit
+		for _, spec := range g.Specs {
+			v := spec.(*ast.ValueSpec)
+			header, ok := funcs[v.Names[0].Name]
+			if !ok {
+				continue
+			}
+			doc, start, end := v.Doc, v.Pos(), v.End()
+			if doc == nil && !g.Lparen.IsValid() {
+				doc = g.Doc
+			}
+			var b strings.Builder
+			if doc != nil {
+				fmt.Fprintf(&b, "%s\n", src[off(doc.Pos()):off(doc.End())])
+				start = doc.Pos()
+			}
+			fmt.Fprintf(&b, "%s {\n\tvar %s", header, src[off(v.Pos()):off(v.End())])
+			if v.Comment != nil {
+				fmt.Fprintf(&b, " %s", src[off(v.Comment.Pos()):off(v.Comment.End())])
+				end = v.Comment.End()
+			}
+			fmt.Fprintf(&b, "\n\treturn %s\n}", v.Names[0].Name)
+			texts = append(texts, b.String())
+			s, e := line(start, end)
+			removed = append(removed, edit{s, e, ""})
+		}
+		switch {
+		case len(texts) == 0:
+		case len(texts) < len(g.Specs):
+			edits = append(edits, removed...)
+			edits = append(edits, edit{off(g.End()), off(g.End()), "\n\n" + strings.Join(texts, "\n\n")})
+		default:
+			start, end := g.Pos(), g.End()
+			if g.Doc != nil {
+				start = g.Doc.Pos()
+				// The doc comment of a group describes the variables in it.
+				if g.Lparen.IsValid() {
+					texts = append([]string{string(src[off(g.Doc.Pos()):off(g.Doc.End())])}, texts...)
+				}
+			}
+			if c := g.Specs[len(g.Specs)-1].(*ast.ValueSpec).Comment; !g.Lparen.IsValid() && c != nil {
+				end = c.End()
+			}
+			// Blank lines around the functions separate them from adjacent declarations, and are merged with
+			// existing ones when formatting.
+			edits = append(edits, edit{off(start), off(end), "\n" + strings.Join(texts, "\n\n") + "\n"})
+		}
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	for _, e := range edits {
+		src = append(src[:e.start:e.start], append([]byte(e.text), src[e.end:]...)...)
+	}
+	return src, nil
+}
+
+// migrate returns the files of the migrated package.
+func (m *migration) migrate() ([]File, error) {
+	paths := sortedPaths(m.files)
+	for _, p := range paths {
+		astutil.Apply(m.files[p], nil, m.instantiate)
+	}
+	// Parameters with methods are constrained by their interfaces, which are printed once references in
+	// them are instantiated.
+	for _, p := range m.params {
+		if it, ok := m.specs[p].Type.(*ast.InterfaceType); ok && len(it.Methods.List) != 0 {
+			for _, f := range it.Methods.List {
+				b, err := m.print(&ast.InterfaceType{Methods: &ast.FieldList{List: []*ast.Field{f}}})
+				if err != nil {
+					return nil, err
+				}
+				// Strip the braces of the single element interface.
+				b = strings.TrimSpace(b[strings.Index(b, "{")+1 : strings.LastIndex(b, "}")])
+				m.ifaces[p] = append(m.ifaces[p], b)
+			}
+		}
+	}
+
+	// Constraints used by type parameters are declared in the file declaring the first parameter.
+	declared := map[constraint]bool{}
+	for _, cs := range m.constraints {
+		for _, c := range cs {
+			_, ok := declaredConstraints[c]
+			declared[c] = declared[c] || ok
+		}
+	}
+	first := m.fs.Position(m.params[0].Pos()).Filename
+
+	var res []File
+	for _, p := range paths {
+		f := m.files[p]
+		m.cmp = false
+		funcs, err := m.migrateDecls(f)
+		if err != nil {
+			return nil, err
+		}
+		if m.cmp {
+			astutil.AddImport(m.fs, f, "cmp")
+		}
+		var b bytes.Buffer
+		if err := format.Node(&b, m.fs, f); err != nil {
+			return nil, errors.Wrapf(err, "%s: code generation failed", p)
+		}
+		for _, c := range []constraint{numberConstraint, integerConstraint} {
+			if declared[c] && p == first {
+				d := declaredConstraints[c]
+				fmt.Fprintf(&b, "\n// %s\ntype %s interface {\n\t%s\n}\n", d.doc, d.name, d.types)
+			}
+		}
+		src, err := varFuncs(b.Bytes(), funcs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: code generation failed", p)
+		}
+		out, err := imports.Process(p, src, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: code generation failed", p)
+		}
+		res = append(res, File{Path: p, Data: out})
+	}
+	return res, nil
+}
+
+// migrateDecls deletes the declarations of parameters from f and declares type parameters for generic functions
+// and types. It returns the headers of the functions replacing generic variables, keyed by variable name.
+func (m *migration) migrateDecls(f *ast.File) (map[string]string, error) {
+	decls := f.Decls[:0]
+	var dropped []ast.Node
+	funcs := map[string]string{}
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			if obj := m.info.Defs[d.Name]; m.generic[obj] != nil && d.Recv == nil {
+				d.Type.TypeParams = m.typeParams(obj)
+			}
+		case *ast.GenDecl:
+			if d.Tok == token.VAR {
+				for _, spec := range d.Specs {
+					v := spec.(*ast.ValueSpec)
+					if m.generic[m.info.Defs[v.Names[0]]] == nil {
+						continue
+					}
+					h, err := m.funcHeader(v)
+					if err != nil {
+						return nil, err
+					}
+					funcs[v.Names[0].Name] = h
+				}
+			}
+			if d.Tok != token.TYPE {
+				break
+			}
+			specs := d.Specs[:0]
+			for _, spec := range d.Specs {
+				t := spec.(*ast.TypeSpec)
+				obj := m.info.Defs[t.Name]
+				if tn, ok := obj.(*types.TypeName); ok && m.specs[tn] != nil {
+					dropped = append(dropped, t)
+					continue
+				}
+				if m.generic[obj] != nil {
+					t.TypeParams = m.typeParams(obj)
+				}
+				specs = append(specs, t)
+			}
+			if len(specs) == 0 {
+				dropped = append(dropped, d)
+				continue
+			}
+			d.Specs = specs
+		}
+		decls = append(decls, d)
+	}
+	f.Decls = decls
+	removeNodes(m.fs, f, dropped)
+	return funcs, nil
+}
+
+// migrateConsumer rewrites references in f to the stencilled package imported as name, specialized using r,
+// to refer to the migrated package, instantiating generic declarations with the types replacing the parameters.
+func (m *migration) migrateConsumer(fs *token.FileSet, f *ast.File, name string, r replacer) error {
+	args := map[*types.TypeName]ast.Expr{}
+	imps := map[string]string{}
+	for _, p := range m.params {
+		t, ok := r[p.Name()]
+		if !ok {
+			args[p] = ast.NewIdent(m.natural[p])
+			continue
+		}
+		tp, err := parseTypePath(t)
+		if err != nil {
+			return err
+		}
+		args[p] = ast.NewIdent(tp.expr)
+		for ip, n := range tp.imports {
+			imps[ip] = n
+		}
+	}
+	astutil.Apply(f, nil, func(c *astutil.Cursor) bool {
+		sel, ok := c.Node().(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if x, ok := sel.X.(*ast.Ident); !ok || x.Name != name || x.Obj != nil {
+			return true
+		}
+		sel.X = &ast.Ident{Name: m.pkg.Name(), NamePos: sel.X.Pos()}
+		obj := m.pkg.Scope().Lookup(sel.Sel.Name)
+		ps, ok := m.generic[obj]
+		if !ok {
+			return true
+		}
+		xs := make([]ast.Expr, len(ps))
+		for i, p := range ps {
+			xs[i] = args[p]
+		}
+		c.Replace(instantiation(obj, sel, xs))
+		return true
+	})
+	for p, n := range imps {
+		if n == path.Base(p) {
+			astutil.AddImport(fs, f, p)
+		} else {
+			astutil.AddNamedImport(fs, f, n, p)
+		}
+	}
+	return nil
+}
+
+// migrate returns the files of the stencil with the import path stencil converted to a package using type
+// parameters, followed by the Go files in paths importing stencilled packages of the stencil, rewritten to
+// import the converted package. The stencil is located as if imported by the first package in paths.
+func migrate(ctx context.Context, stencil string, paths []string, opts options) ([]File, error) {
+	if opts.fs == nil {
+		opts.fs = newFileSystem(nil, nil)
+	}
+	dirs, err := listPackages(opts.fs, paths, opts.tests)
+	if err != nil {
+		return nil, err
+	}
+	sorted := make([]string, 0, len(dirs))
+	for d := range dirs {
+		sorted = append(sorted, d)
+	}
+	sort.Strings(sorted)
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(sorted) != 0 {
+		dir = sorted[0]
+	}
+	l, err := newLayout(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	sdir, ok := l.exists(stencil)
+	if !ok {
+		return nil, errors.Errorf("stencil %s not found", stencil)
+	}
+	if !editable(l, sdir) {
+		return nil, errors.Errorf("%s: stencils in %s cannot be migrated, since they are not part of the main module or a GOPATH workspace", stencil, sdir)
+	}
+	all, err := goFiles(opts.fs, sdir, true)
+	if err != nil {
+		return nil, err
+	}
+	// Tests of the stencil refer to the declarations of its parameters, which are deleted, so they would no
+	// longer compile.
+	var spaths, tests []string
+	for _, p := range all {
+		if strings.HasSuffix(p, "_test.go") {
+			tests = append(tests, filepath.Base(p))
+		} else {
+			spaths = append(spaths, p)
+		}
+	}
+	if len(tests) != 0 {
+		return nil, errors.Errorf("%s: stencils with tests cannot be migrated, remove or convert %s first", stencil, strings.Join(tests, ", "))
+	}
+	fs := token.NewFileSet()
+	files := map[string]*ast.File{}
+	for _, p := range spaths {
+		b, err := opts.fs.ReadFile(p)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if files[p], err = parser.ParseFile(fs, p, b, parser.ParseComments); err != nil {
+			return nil, errors.Wrapf(err, "%s: errors parsing", stencil)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.Errorf("%s: no Go files in the stencil", stencil)
+	}
+	info := &types.Info{
+		Types: map[ast.Expr]types.TypeAndValue{},
+		Defs:  map[*ast.Ident]types.Object{},
+		Uses:  map[*ast.Ident]types.Object{},
+	}
+	fl := make([]*ast.File, 0, len(files))
+	for _, p := range sortedPaths(files) {
+		fl = append(fl, files[p])
+	}
+	// Type errors are ignored, as when generating stencilled packages.
+	conf := types.Config{Importer: newSourceImporter(l.context(), fs, opts.fs), Error: func(error) {}}
+	pkg, _ := conf.Check(stencil, fs, fl, info)
+	m, err := newMigration(fs, pkg, info, files)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s", stencil)
+	}
+	res, err := m.migrate()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range sorted {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		cl, err := newLayout(d, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range dirs[d] {
+			f, err := migrateFile(m, cl, stencil, p, opts)
+			if err != nil {
+				return nil, err
+			}
+			if f != nil {
+				res = append(res, *f)
+			}
+		}
+	}
+	return res, nil
+}
+
+// editable returns true if dir, the directory of a stencil located using l, is in the main module or a GOPATH
+// workspace, outside any vendor directory, so that the stencil can be rewritten in place. Stencils in the module
+// cache, in GOROOT or vendored are shared, and must not be changed.
+func editable(l layout, dir string) bool {
+	var roots []string
+	switch l := l.(type) {
+	case *module:
+		roots = []string{l.root}
+	case *gopathLayout:
+		for _, p := range filepath.SplitList(l.ctx.GOPATH) {
+			roots = append(roots, filepath.Join(p, "src"))
+		}
+	}
+	for _, r := range roots {
+		rel, err := filepath.Rel(r, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		for _, e := range strings.Split(filepath.ToSlash(rel), "/") {
+			if e == "vendor" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// migrateFile returns the Go file at path, located using l, rewritten to use the migrated package m instead of
+// the stencilled packages of the stencil with import path stencil it imports, or nil if it imports none.
+func migrateFile(m *migration, l layout, stencil, path string, opts options) (*File, error) {
+	src, err := opts.fs.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fs := token.NewFileSet()
+	f, err := parser.ParseFile(fs, path, src, parser.ParseComments)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: parse failed", path)
+	}
+	var found bool
+	// The first import using the stencil is rewritten in place, keeping its group, and the others are deleted.
+	var kept *ast.ImportSpec
+	for _, imp := range append([]*ast.ImportSpec(nil), f.Imports...) {
+		ipath, _ := strconv.Unquote(imp.Path.Value)
+		spath, ok := l.stencil(ipath)
+		if !ok {
+			continue
+		}
+		_, base, r, err := replacements(l.exists, spath)
+		if err != nil {
+			return nil, &Error{Pos: fs.Position(imp.Pos()), Import: ipath, Err: err}
+		}
+		if base != stencil {
+			continue
+		}
+		r = r.withDefaults(opts.defaults[base].withDefaults(m.defaults))
+		name := m.pkg.Name()
+		switch {
+		case imp.Name != nil:
+			name = imp.Name.Name
+		case opts.names[spath] != "":
+			name = opts.names[spath]
+		case opts.rename:
+			if name, err = specializedName(name, r); err != nil {
+				return nil, err
+			}
+		}
+		if name == "." {
+			return nil, &Error{Pos: fs.Position(imp.Pos()), Import: ipath, Err: errors.New("dot imports cannot be migrated")}
+		}
+		found = true
+		if name != "_" {
+			if err := m.migrateConsumer(fs, f, name, r); err != nil {
+				return nil, &Error{Pos: fs.Position(imp.Pos()), Import: ipath, Err: err}
+			}
+		}
+		if name == "_" || kept != nil {
+			iname := ""
+			if imp.Name != nil {
+				iname = imp.Name.Name
+			}
+			astutil.DeleteNamedImport(fs, f, iname, ipath)
+			continue
+		}
+		kept = imp
+		imp.Path.Value = strconv.Quote(stencil)
+		imp.Name = nil
+		if packageName(stencil) != m.pkg.Name() {
+			imp.Name = &ast.Ident{Name: m.pkg.Name(), NamePos: imp.Path.Pos()}
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	var b bytes.Buffer
+	if err := format.Node(&b, fs, f); err != nil {
+		return nil, errors.Wrapf(err, "%s: failed to rewrite imports", path)
+	}
+	out, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: failed to rewrite imports", path)
+	}
+	return &File{Path: path, Data: out, consumer: true}, nil
+}
@@ -0,0 +1,108 @@
+package stencil
+
+import (
+	"go/build"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/mod/modfile"
+)
+
+// moduleGenDir is the directory, relative to the module root, that stencilled packages are generated in by default.
+const moduleGenDir = "generated"
+
+// module finds stencils using the module graph of a Go module and generates stencilled packages
+// in the generated directory at the root of the module.
+type module struct {
+	fs   *fileSystem
+	root string
+	path string
+	// gen is the directory stencilled packages are generated in.
+	gen string
+	ctx build.Context
+}
+
+// findModule returns the module containing dir, read from v and located using ctx, or nil if modules are
+// disabled or dir is not in a module.
+func findModule(v *fileSystem, dir string, ctx build.Context) (*module, error) {
+	if os.Getenv("GO111MODULE") == "off" {
+		return nil, nil
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		b, err := v.ReadFile(filepath.Join(d, "go.mod"))
+		if err == nil {
+			p := modfile.ModulePath(b)
+			if p == "" {
+				return nil, errors.Errorf("%s: no module path in go.mod", d)
+			}
+			// The go command is run in ctx.Dir to locate packages. It cannot read files in an fs.FS.
+			ctx.Dir = d
+			if v.fsys != nil {
+				v.setHooks(&ctx)
+			}
+			return &module{fs: v, root: d, path: p, gen: filepath.Join(d, moduleGenDir), ctx: ctx}, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, errors.WithStack(err)
+		}
+		if d == filepath.Dir(d) {
+			return nil, nil
+		}
+	}
+}
+
+// setOutputDir generates stencilled packages in dir, which must be in the module.
+func (m *module) setOutputDir(dir string) error {
+	gen, err := filepath.Abs(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	rel, err := filepath.Rel(m.root, gen)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errors.Errorf("output directory %s: not in module %s", dir, m.path)
+	}
+	m.gen = gen
+	return nil
+}
+
+// genPath is the import path prefix of stencilled packages generated in m.
+func (m *module) genPath() string {
+	rel, _ := filepath.Rel(m.root, m.gen)
+	return path.Join(m.path, filepath.ToSlash(rel)) + "/"
+}
+
+// stencil returns the stencilled import path for p, stripping the generated package prefix if present.
+func (m *module) stencil(p string) (string, bool) {
+	return strings.TrimPrefix(p, m.genPath()), true
+}
+
+// exists uses the go command to resolve pkg using the module graph, taking replace directives and
+// the module cache into account. If files are read from an fs.FS, only packages in the module are found.
+func (m *module) exists(pkg string) (string, bool) {
+	if m.fs.fsys != nil {
+		if pkg != m.path && !strings.HasPrefix(pkg, m.path+"/") {
+			return "", false
+		}
+		dir := filepath.Join(m.root, filepath.FromSlash(strings.TrimPrefix(pkg, m.path)))
+		if s, err := m.fs.Stat(dir); err == nil && s.IsDir() {
+			return dir, true
+		}
+		return "", false
+	}
+	p, err := m.ctx.Import(pkg, m.root, build.FindOnly)
+	if err != nil || p.Dir == "" {
+		return "", false
+	}
+	return p.Dir, true
+}
+
+func (m *module) target(p string) (string, string) {
+	return filepath.Join(m.gen, filepath.FromSlash(p)), m.genPath() + p
+}
+
+func (m *module) context() *build.Context { return &m.ctx }
+
+func (m *module) outputDir() string { return m.gen }
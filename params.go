@@ -0,0 +1,198 @@
+package stencil
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// declaresOrUses returns true if obj is declared in pkg or used by the stencil with the type information info.
+func declaresOrUses(pkg *types.Package, info *types.Info, obj types.Object) bool {
+	if obj.Pkg() == pkg {
+		return true
+	}
+	for _, o := range info.Uses {
+		if o == obj {
+			return true
+		}
+	}
+	return false
+}
+
+// stencilTypes returns the names of the types declared in pkg and the predeclared types used by the stencil,
+// sorted.
+func stencilTypes(pkg *types.Package, info *types.Info) []string {
+	seen := map[string]bool{}
+	for _, n := range pkg.Scope().Names() {
+		if _, ok := pkg.Scope().Lookup(n).(*types.TypeName); ok {
+			seen[n] = true
+		}
+	}
+	for _, o := range info.Uses {
+		if _, ok := o.(*types.TypeName); ok && o.Parent() == types.Universe {
+			seen[o.Name()] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unknownParam returns the error for the substituted parameter name, which is not one of names, the types in
+// the stencil. The error suggests the closest type in names, if any is close enough to be a likely typo.
+func unknownParam(name string, names []string) error {
+	best, dist := "", len(name)/2+1
+	for _, t := range names {
+		if d := editDistance(name, t); d < dist {
+			best, dist = t, d
+		}
+	}
+	if best == "" {
+		return errors.Errorf("no type %s in the stencil", name)
+	}
+	return errors.Errorf("no type %s in the stencil, did you mean %s?", name, best)
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// paramDirective marks the declaration of a type as a parameter of its stencil. It may be followed by
+// default=<type> to give the type replacing the parameter when an import path does not substitute it,
+// written as in import paths.
+const paramDirective = "//stencil:param"
+
+// defaultOption is the prefix of the option of paramDirective giving the default of a parameter.
+const defaultOption = "default="
+
+// stencilParams returns the sorted names of the types marked as parameters in files, or nil if none are,
+// along with the defaults of the parameters that have one.
+func stencilParams(files map[string]*ast.File) ([]string, replacer, error) {
+	var params []string
+	defaults := replacer{}
+	for _, f := range files {
+		for _, d := range f.Decls {
+			g, ok := d.(*ast.GenDecl)
+			if !ok || g.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range g.Specs {
+				t := spec.(*ast.TypeSpec)
+				groups := []*ast.CommentGroup{t.Doc, t.Comment}
+				if len(g.Specs) == 1 && !g.Lparen.IsValid() {
+					groups = append(groups, g.Doc)
+				}
+				c := paramComment(groups...)
+				if c == nil {
+					continue
+				}
+				params = append(params, t.Name.Name)
+				def, err := paramDefault(c)
+				if err != nil {
+					return nil, nil, errors.Wrapf(err, "parameter %s", t.Name.Name)
+				}
+				if def != "" {
+					defaults[t.Name.Name] = def
+				}
+			}
+		}
+	}
+	sort.Strings(params)
+	return params, defaults, nil
+}
+
+// hasParamDirective returns true if any of groups holds paramDirective.
+func hasParamDirective(groups ...*ast.CommentGroup) bool {
+	return paramComment(groups...) != nil
+}
+
+// paramComment returns the comment in groups holding paramDirective, if any.
+func paramComment(groups ...*ast.CommentGroup) *ast.Comment {
+	for _, g := range groups {
+		if g == nil {
+			continue
+		}
+		for _, c := range g.List {
+			if isParamDirective(c) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+func isParamDirective(c *ast.Comment) bool {
+	text := strings.TrimSpace(c.Text)
+	return text == paramDirective || strings.HasPrefix(text, paramDirective+" ")
+}
+
+// paramDefault returns the default given by c, a comment holding paramDirective, or "" if it has none.
+func paramDefault(c *ast.Comment) (string, error) {
+	var def string
+	for _, opt := range strings.Fields(strings.TrimPrefix(strings.TrimSpace(c.Text), paramDirective)) {
+		if !strings.HasPrefix(opt, defaultOption) {
+			return "", errors.Errorf("unknown option %q in %s", opt, paramDirective)
+		}
+		def = strings.TrimPrefix(opt, defaultOption)
+		if _, err := parseTypePath(def); err != nil {
+			return "", err
+		}
+	}
+	return def, nil
+}
+
+// withDefaults returns r with the parameters it does not substitute replaced by their defaults.
+func (r replacer) withDefaults(defaults replacer) replacer {
+	all := replacer{}
+	for k, v := range defaults {
+		all[k] = v
+	}
+	for k, v := range r {
+		all[k] = v
+	}
+	return all
+}
+
+// notParam returns the error for substituting name, which is not one of params, the parameters of the stencil pkg.
+func notParam(pkg *types.Package, name string, params []string) error {
+	if pkg != nil {
+		if _, ok := pkg.Scope().Lookup(name).(*types.TypeName); ok {
+			return errors.Errorf("%s is not a parameter of the stencil, whose parameters are %s",
+				name, strings.Join(params, ", "))
+		}
+	}
+	return unknownParam(name, params)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package stencil
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Version is the version of stencil, recorded in generated files.
+const Version = "0.2.0"
+
+// generatedHeader is the first line of every generated file, following the Go convention for generated code.
+const generatedHeader = "// Code generated by stencil. DO NOT EDIT."
+
+// Provenance describes how a generated file was generated. It is recorded in a comment at the top of the file.
+type Provenance struct {
+	// Stencil is the import path of the stencil.
+	Stencil string
+	// Hash is a hash of the contents of the stencil's files, including its tests only in generated test files.
+	Hash string
+	// Substitutions maps the replaced types to the types replacing them, as written in the import path.
+	Substitutions map[string]string
+	// Version is the version of stencil that generated the file.
+	Version string
+}
+
+// header returns the comment recording p, to be placed at the top of a generated file.
+func (p *Provenance) header() []byte {
+	keys := make([]string, 0, len(p.Substitutions))
+	for k := range p.Substitutions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	subs := make([]string, len(keys))
+	for i, k := range keys {
+		subs[i] = k + "=" + p.Substitutions[k]
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintln(&b, generatedHeader)
+	fmt.Fprintln(&b, "//")
+	fmt.Fprintln(&b, "// Stencil:", p.Stencil)
+	fmt.Fprintln(&b, "// Hash:", p.Hash)
+	fmt.Fprintln(&b, "// Substitutions:", strings.Join(subs, ", "))
+	fmt.Fprintln(&b, "// Version:", p.Version)
+	fmt.Fprintln(&b)
+	return b.Bytes()
+}
+
+// ReadProvenance reads the provenance recorded in data, the contents of a file generated by stencil.
+// It returns false if data was not generated by stencil.
+func ReadProvenance(data []byte) (*Provenance, bool) {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	if !s.Scan() || s.Text() != generatedHeader {
+		return nil, false
+	}
+	p := &Provenance{Substitutions: map[string]string{}}
+	for s.Scan() && strings.HasPrefix(s.Text(), "//") {
+		kv := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(s.Text(), "//")), ": ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Stencil":
+			p.Stencil = kv[1]
+		case "Hash":
+			p.Hash = kv[1]
+		case "Version":
+			p.Version = kv[1]
+		case "Substitutions":
+			for _, sub := range strings.Split(kv[1], ", ") {
+				if r := strings.SplitN(sub, "=", 2); len(r) == 2 {
+					p.Substitutions[r[0]] = r[1]
+				}
+			}
+		}
+	}
+	return p, true
+}
+
+// stencilHashes returns the hash of the files of a stencil at paths, read from v, recorded in the provenance of
+// generated files, and the hash recorded in generated test files. Test files only affect the latter, so that
+// generating tests leaves the other files unchanged.
+func stencilHashes(v *fileSystem, paths []string) (string, string, error) {
+	var srcs []string
+	for _, p := range paths {
+		if !strings.HasSuffix(p, "_test.go") {
+			srcs = append(srcs, p)
+		}
+	}
+	hash, err := hashStencil(v, srcs)
+	if err != nil {
+		return "", "", err
+	}
+	if len(srcs) == len(paths) {
+		return hash, hash, nil
+	}
+	testHash, err := hashStencil(v, paths)
+	return hash, testHash, err
+}
+
+// hashStencil returns a hash of the names and contents of the files at paths, read from v.
+func hashStencil(v *fileSystem, paths []string) (string, error) {
+	h := sha256.New()
+	for _, p := range paths {
+		b, err := v.ReadFile(p)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.Base(p), len(b))
+		h.Write(b)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,112 @@
+package stencil
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// stencilName returns the package name of the stencil with the files at paths, read from v.
+func stencilName(v *fileSystem, stencil string, paths []string) (string, error) {
+	for _, p := range paths {
+		if strings.HasSuffix(p, "_test.go") {
+			continue
+		}
+		b, err := v.ReadFile(p)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), p, b, parser.PackageClauseOnly)
+		if err != nil {
+			return "", errors.Wrapf(err, "%s: errors parsing", stencil)
+		}
+		return f.Name.Name, nil
+	}
+	return "", errors.Errorf("%s: no Go files in the stencil", stencil)
+}
+
+// qualifier matches the package names qualifying types.
+var qualifier = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*\.`)
+
+// specializedName returns the name of the package specializing the stencil package name using r. The name
+// is prefixed with the types replacing the parameters of the stencil, in the order of the parameters,
+// so that std/slice/T/int is named intslice.
+func specializedName(name string, r replacer) (string, error) {
+	keys := make([]string, 0, len(r))
+	for k := range r {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		t, err := parseTypePath(r[k])
+		if err != nil {
+			return "", err
+		}
+		for _, c := range qualifier.ReplaceAllString(t.expr, "") {
+			if unicode.IsLetter(c) || unicode.IsDigit(c) && b.Len() > 0 {
+				b.WriteRune(unicode.ToLower(c))
+			}
+		}
+	}
+	return b.String() + name, nil
+}
+
+// rename renames f, a file of the stencil package name, to the package newName. Parameter names replaced by
+// s are replaced in the comments of f, except in indented code blocks and import paths.
+func (s *substitution) rename(f *ast.File, name, newName string) {
+	switch f.Name.Name {
+	case name:
+		f.Name.Name = newName
+	case name + "_test":
+		f.Name.Name = newName + "_test"
+	}
+	names := map[string]string{}
+	for obj, expr := range s.objs {
+		names[obj.Name()] = expr
+	}
+	for _, g := range f.Comments {
+		for _, c := range g.List {
+			c.Text = renameComment(c.Text, name, newName, names)
+		}
+	}
+}
+
+// ident matches identifiers in comments.
+var ident = regexp.MustCompile(`[\p{L}_][\p{L}\p{N}_]*`)
+
+// renameComment returns the comment text with the package name replaced by newName in a package clause
+// and the names in names replaced by their replacements. Names in paths and selectors are left alone.
+func renameComment(text, name, newName string, names map[string]string) string {
+	lines := strings.Split(text, "\n")
+	for i, l := range lines {
+		body := strings.TrimPrefix(l, "//")
+		if strings.HasPrefix(body, "\t") {
+			continue
+		}
+		if strings.HasPrefix(body, " Package "+name+" ") {
+			l = "// Package " + newName + strings.TrimPrefix(body, " Package "+name)
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range ident.FindAllStringIndex(l, -1) {
+			rep, ok := names[l[m[0]:m[1]]]
+			if !ok || m[0] > 0 && strings.ContainsRune("/.~", rune(l[m[0]-1])) ||
+				m[1] < len(l) && strings.ContainsRune("/~", rune(l[m[1]])) {
+				continue
+			}
+			b.WriteString(l[last:m[0]])
+			b.WriteString(rep)
+			last = m[1]
+		}
+		b.WriteString(l[last:])
+		lines[i] = b.String()
+	}
+	return strings.Join(lines, "\n")
+}
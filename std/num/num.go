@@ -6,6 +6,9 @@
 package num
 
 
+// Number is the type of the numbers.
+//
+//stencil:param
 type Number float64
 
 // Max returns the largest number in n
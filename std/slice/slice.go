@@ -16,6 +16,9 @@ import (
 	"sort"
 )
 
+// T is the type of the elements of the slices.
+//
+//stencil:param
 type T interface{}
 
 // Any returns true if fn is true for any elements of s
@@ -2,10 +2,14 @@
 package stencil
 
 import (
+	"context"
 	"go/ast"
 	"go/format"
 	"go/parser"
 	"go/token"
+	"go/types"
+	"path"
+	"sort"
 	"strings"
 
 	"bytes"
@@ -14,116 +18,329 @@ import (
 
 	"os"
 
-	"io/ioutil"
-
 	"go/build"
 
 	"josharian/apply"
 
 	"github.com/pkg/errors"
+	"golang.org/x/tools/go/ast/astutil"
 	"golang.org/x/tools/imports"
 )
 
-type file struct {
-	data []byte
-	path string
+// File is a file generated by stencil.
+type File struct {
+	Path string
+	Data []byte
+	// consumer is true for files importing stencilled packages, rewritten to use the generated packages.
+	consumer bool
 }
 
 // Process process paths, generating vendored, specialized code for any stencil import paths.
 // If format is true any go files in paths are processed using goimports.
+// Stencilled packages whose provenance shows they are up to date are not generated again.
 //
 // For detailed documentation consult the docs for "github.com/sridharv/stencil/cmd/stencil"
 func Process(paths []string, format bool) error {
-	files, err := processStencil(paths)
+	_, err := NewGenerator(Options{Format: format}).Process(context.Background(), paths)
+	return err
+}
+
+// ProcessWithTests is like Process, but also specializes the tests of stencils, so that the tests
+// can be run against stencilled packages. Stencils imported by test files in paths are generated as well.
+func ProcessWithTests(paths []string, format bool) error {
+	_, err := NewGenerator(Options{Format: format, Tests: true}).Process(context.Background(), paths)
+	return err
+}
+
+// Generate returns the files Process would write for paths, without writing them. If tests is true, the
+// files generated by ProcessWithTests are returned.
+func Generate(paths []string, tests bool) ([]File, error) {
+	return NewGenerator(Options{Tests: tests}).Generate(context.Background(), paths)
+}
+
+// options configure how stencilled packages are generated.
+type options struct {
+	// tests specializes the tests of stencils along with the stencils.
+	tests bool
+	// cache skips generating stencilled packages that are up to date on disk.
+	cache bool
+	// workers is the number of stencilled packages generated concurrently. If zero, GOMAXPROCS is used.
+	workers int
+	// failFast stops generating stencilled packages after the first error.
+	failFast bool
+	// outputDir, if set, is the directory stencilled packages are generated in.
+	outputDir string
+	// output selects the directory stencilled packages are generated in if outputDir is empty.
+	output OutputMode
+	// buildContext, if set, is used to locate packages instead of go/build.Default.
+	buildContext *build.Context
+	// fs reads files. If nil, files are read from disk.
+	fs *fileSystem
+	// rename names stencilled packages after their substitutions and specializes their comments.
+	rename bool
+	// specs are stencilled packages to generate whether or not they are imported.
+	specs []Specialization
+	// permissive allows substituting types not marked as parameters in stencils declaring parameters.
+	permissive bool
+	// names maps stencilled import paths to the package names of the packages generated for them, overriding
+	// the names of their stencils.
+	names map[string]string
+	// defaults maps the import paths of stencils to the defaults of their parameters, overriding those
+	// given by their //stencil:param comments.
+	defaults map[string]replacer
+}
+
+// doImports runs goimports on the Go files of the packages in paths, listed as by listPackages and read from v,
+// writing those that change using w.
+func doImports(v *fileSystem, paths []string, tests bool, w Writer) error {
+	dirs, err := listPackages(v, paths, tests)
 	if err != nil {
 		return err
 	}
-
-	for _, f := range files {
-		dir := filepath.Dir(f.path)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return errors.WithStack(err)
-		}
-		if err := ioutil.WriteFile(f.path, f.data, 0644); err != nil {
-			return errors.WithStack(err)
-		}
+	var files []string
+	for _, fs := range dirs {
+		files = append(files, fs...)
 	}
-	if !format {
-		return nil
-	}
-	return doImports(paths)
-}
-
-func doImports(paths []string) error {
-	for _, p := range paths {
-		s, err := os.Stat(p)
+	sort.Strings(files)
+	for _, p := range files {
+		b, err := v.ReadFile(p)
 		if err != nil {
-			return errors.WithStack(err)
-		}
-		if s.IsDir() {
-			continue
+			return errors.Wrapf(err, "%s", p)
 		}
-		b, err := ioutil.ReadFile(p)
+		out, err := imports.Process(p, b, nil)
 		if err != nil {
 			return errors.Wrapf(err, "%s", p)
 		}
-		if b, err = imports.Process(p, b, nil); err != nil {
-			return errors.Wrapf(err, "%s", p)
+		if bytes.Equal(out, b) {
+			continue
 		}
-		if err = ioutil.WriteFile(p, b, s.Mode()); err != nil {
+		if err = w.WriteFile(p, out); err != nil {
 			return errors.Wrapf(err, "failed to write %s", p)
 		}
 	}
 	return nil
 }
 
+// replacer maps the names of types in a stencil to the names of the types replacing them.
 type replacer map[string]string
 
-func (r replacer) preReplace(c apply.ApplyCursor) bool {
+// substitution rewrites identifiers in a type checked stencil that refer to one of the replaced types.
+type substitution struct {
+	info *types.Info
+	// objs maps the objects of replaced types to the expressions replacing them.
+	objs map[types.Object]string
+	// iface is the expression replacing interface{}, if any.
+	iface string
+	// imports maps the import paths needed by replacements to package names.
+	imports map[string]string
+	// dropped holds the type specifications deleted from grouped declarations, and the deleted declarations
+	// of parameters, or of any type if docs is true.
+	dropped []ast.Node
+	// docs removes the doc comments of deleted declarations, which would otherwise be kept.
+	docs bool
+}
+
+// newSubstitution resolves the names in r against the scope of pkg, falling back to predeclared types.
+// If params is not nil, only the names in it can be substituted.
+func newSubstitution(pkg *types.Package, info *types.Info, r replacer, params []string) (*substitution, error) {
+	s := &substitution{
+		info:    info,
+		objs:    map[types.Object]string{},
+		imports: map[string]string{},
+	}
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if params != nil && !contains(params, name) {
+			return nil, notParam(pkg, name, params)
+		}
+		t, err := parseTypePath(r[name])
+		if err != nil {
+			return nil, err
+		}
+		for p, n := range t.imports {
+			s.imports[p] = n
+		}
+		if name == "interface" {
+			s.iface = t.expr
+			continue
+		}
+		obj := types.Universe.Lookup(name)
+		if pkg != nil {
+			if o := pkg.Scope().Lookup(name); o != nil {
+				obj = o
+			}
+		}
+		if _, ok := obj.(*types.TypeName); !ok || pkg != nil && !declaresOrUses(pkg, info, obj) {
+			if pkg != nil {
+				return nil, unknownParam(name, stencilTypes(pkg, info))
+			}
+			continue
+		}
+		s.objs[obj] = t.expr
+	}
+	return s, nil
+}
+
+// replaced returns the replacement for the type defined or used by id, if any.
+func (s *substitution) replaced(id *ast.Ident) (string, bool) {
+	obj := s.info.Defs[id]
+	if obj == nil {
+		obj = s.info.Uses[id]
+	}
+	if obj == nil {
+		return "", false
+	}
+	rep, ok := s.objs[obj]
+	return rep, ok
+}
+
+// exprAt returns rep, parenthesized if needed to be used as the type in a conversion at c.
+func exprAt(c apply.ApplyCursor, rep string) string {
+	if call, ok := c.Parent().(*ast.CallExpr); ok && call.Fun == c.Node() {
+		if strings.HasPrefix(rep, "*") || strings.HasPrefix(rep, "<-") {
+			return "(" + rep + ")"
+		}
+	}
+	return rep
+}
+
+func (s *substitution) preReplace(c apply.ApplyCursor) bool {
 	switch t := c.Node().(type) {
 	case *ast.GenDecl:
-		// Delete named type specifications that will be replaced.
-		if len(t.Specs) == 0 {
+		// Delete named type specifications that will be replaced, keeping the rest of a grouped declaration.
+		if t.Tok != token.TYPE {
 			return true
 		}
-		spec, ok := t.Specs[0].(*ast.TypeSpec)
-		if !ok {
+		specs := t.Specs[:0]
+		for _, spec := range t.Specs {
+			if _, ok := s.replaced(spec.(*ast.TypeSpec).Name); ok {
+				s.dropped = append(s.dropped, spec)
+				continue
+			}
+			specs = append(specs, spec)
+		}
+		if len(specs) == 0 && len(t.Specs) > 0 {
+			// The doc comment of a parameter describes the type it is replaced by.
+			if s.docs || hasParamDirective(t.Doc) {
+				s.dropped = append(s.dropped, t)
+			}
+			c.Delete()
 			return true
 		}
-
-		if _, ok = r[spec.Name.Name]; !ok {
+		t.Specs = specs
+	case *ast.SelectorExpr:
+		// Qualified references to replaced types, from external tests of the stencil.
+		if _, isPkg := t.X.(*ast.Ident); !isPkg {
 			return true
 		}
-		c.Delete()
+		if rep, ok := s.replaced(t.Sel); ok {
+			c.Replace(&ast.Ident{
+				Name:    exprAt(c, rep),
+				NamePos: t.Pos(),
+			})
+			return false
+		}
 	case *ast.Ident:
 		if t == nil {
 			return true
 		}
-		if s, ok := r[t.Name]; ok {
-			t.Name = s
+		if rep, ok := s.replaced(t); ok {
+			t.Name = exprAt(c, rep)
 		}
 	case *ast.InterfaceType:
-		rep, ok := r["interface"]
-		if !ok {
+		if s.iface == "" {
 			return true
 		}
 		if _, isType := c.Parent().(*ast.TypeSpec); isType {
 			return true
 		}
 		c.Replace(&ast.Ident{
-			Name:    rep,
+			Name:    exprAt(c, s.iface),
 			NamePos: t.Pos(),
 		})
 	}
 	return true
 }
 
-func listPackages(paths []string) (map[string][]string, error) {
+// removeDropped removes the comments of the declarations and type specifications deleted from f,
+// and the lines they occupied, so that the rest of the group is formatted as if they were never there.
+func (s *substitution) removeDropped(fs *token.FileSet, f *ast.File) {
+	removeNodes(fs, f, s.dropped)
+}
+
+// removeNodes removes the comments of dropped, declarations and type specifications deleted from f, and the lines
+// they occupied.
+func removeNodes(fs *token.FileSet, f *ast.File, dropped []ast.Node) {
+	comments := map[*ast.CommentGroup]bool{}
+	var spans [][2]token.Pos
+	for _, n := range dropped {
+		start, end := n.Pos(), n.End()
+		var doc, comment *ast.CommentGroup
+		switch n := n.(type) {
+		case *ast.TypeSpec:
+			doc, comment = n.Doc, n.Comment
+		case *ast.GenDecl:
+			doc = n.Doc
+		}
+		if doc != nil {
+			comments[doc], start = true, doc.Pos()
+		}
+		if comment != nil {
+			comments[comment], end = true, comment.End()
+		}
+		if fs.File(start) == fs.File(f.Pos()) {
+			spans = append(spans, [2]token.Pos{start, end})
+		}
+	}
+	kept := f.Comments[:0]
+	for _, c := range f.Comments {
+		if !comments[c] {
+			kept = append(kept, c)
+		}
+	}
+	f.Comments = kept
+
+	// Merge lines from the last span backwards, since merging renumbers the lines after it.
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] > spans[j][0] })
+	tf := fs.File(f.Pos())
+	for _, sp := range spans {
+		first, last := tf.Line(sp[0]), tf.Line(sp[1])
+		for l := first; l <= last && first < tf.LineCount(); l++ {
+			tf.MergeLine(first)
+		}
+	}
+}
+
+// addImports adds the imports needed by the replacements to f.
+func (s *substitution) addImports(fs *token.FileSet, f *ast.File) {
+	for p, name := range s.imports {
+		if name == path.Base(p) {
+			astutil.AddImport(fs, f, p)
+			continue
+		}
+		astutil.AddNamedImport(fs, f, name, p)
+	}
+}
+
+// listPackages returns the Go files in paths, grouped by directory. Test files are included if tests is true.
+// A path ending in /... includes all packages in the directory tree rooted at it, except for vendor and testdata
+// directories and stencilled packages.
+func listPackages(v *fileSystem, paths []string, tests bool) (map[string][]string, error) {
 	if len(paths) == 0 {
 		paths = append(paths, ".")
 	}
 	dirs := map[string][]string{}
 	for _, arg := range paths {
+		if strings.HasSuffix(arg, "/...") || arg == "..." {
+			if err := listTree(v, strings.TrimSuffix(arg, "..."), tests, dirs); err != nil {
+				return nil, err
+			}
+			continue
+		}
 		c, err := filepath.Abs(arg)
 		if err != nil {
 			return nil, errors.WithStack(err)
@@ -133,38 +350,94 @@ func listPackages(paths []string) (map[string][]string, error) {
 			dirs[dir] = append(dirs[dir], c)
 			continue
 		}
-		infos, err := ioutil.ReadDir(c)
+		files, err := goFiles(v, c, tests)
 		if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		var files []string
-		for _, i := range infos {
-			n := i.Name()
-			if strings.HasSuffix(n, ".go") && !strings.HasSuffix(n, "_test.go") {
-				files = append(files, filepath.Join(c, n))
-			}
+			return nil, err
 		}
 		dirs[c] = files
 	}
 	return dirs, nil
 }
 
-func packageExists(roots []string, pkg string) (string, bool) {
+// goFiles returns the Go files in dir. Test files are included if tests is true.
+func goFiles(v *fileSystem, dir string, tests bool) ([]string, error) {
+	infos, err := v.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var files []string
+	for _, i := range infos {
+		n := i.Name()
+		if !i.IsDir() && strings.HasSuffix(n, ".go") && (tests || !strings.HasSuffix(n, "_test.go")) {
+			files = append(files, filepath.Join(dir, n))
+		}
+	}
+	return files, nil
+}
+
+// listTree adds the Go files of packages in the directory tree rooted at root to dirs.
+func listTree(v *fileSystem, root string, tests bool, dirs map[string][]string) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return v.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		n := info.Name()
+		if p != root && (n == "vendor" || n == "testdata" || strings.HasPrefix(n, ".") || strings.HasPrefix(n, "_")) {
+			return filepath.SkipDir
+		}
+		files, err := goFiles(v, p, tests)
+		if err != nil || len(files) == 0 {
+			return err
+		}
+		if b, err := v.ReadFile(files[0]); err == nil {
+			if _, ok := ReadProvenance(b); ok {
+				return filepath.SkipDir
+			}
+		}
+		dirs[p] = files
+		return nil
+	})
+}
+
+func packageExists(v *fileSystem, roots []string, pkg string) (string, bool) {
 	for _, r := range roots {
 		// Rough heuristic to check if a package exists.
 		dir := filepath.Join(r, pkg)
-		if s, err := os.Stat(dir); err == nil && s.IsDir() {
+		if s, err := v.Stat(dir); err == nil && s.IsDir() {
 			return dir, true
 		}
 	}
 	return "", false
 }
 
-func replacements(roots []string, pkg string) (string, replacer) {
+// paramMarker is the path element separating the import path of a stencil from its substitutions, in the
+// explicit syntax for stencilled import paths, for instance collections/map/_/K/string/V/int.
+const paramMarker = "_"
+
+// replacements splits pkg into the stencil it refers to and the replacements to apply to it.
+// It returns the directory and import path of the stencil. exists returns the directory of a package, if it exists.
+// An error is returned if pkg uses the explicit syntax but is not a valid stencilled import path.
+func replacements(exists func(pkg string) (string, bool), pkg string) (string, string, replacer, error) {
 	parts, path := strings.Split(pkg, "/"), pkg
+	dir, found := exists(path)
+	if found {
+		return "", "", nil, nil
+	}
+	for i := len(parts) - 1; i > 0; i-- {
+		if parts[i] == paramMarker {
+			return explicitReplacements(exists, strings.Join(parts[:i], "/"), parts[i+1:])
+		}
+	}
+
 	// See if we can form a substitution pattern from the parts here
 	r := replacer{}
-	dir, found := packageExists(roots, path)
 	for !found && len(parts) > 2 {
 		l := len(parts)
 		// A path looks like github.com/foo/bar/Parameter/Specialization
@@ -172,48 +445,356 @@ func replacements(roots []string, pkg string) (string, replacer) {
 		r[parts[l-2]] = parts[l-1]
 		parts = parts[:l-2]
 		path = strings.Join(parts, "/")
-		dir, found = packageExists(roots, path)
+		dir, found = exists(path)
 	}
 	if !found || len(r) == 0 {
-		return "", nil
+		return "", "", nil, nil
+	}
+	return dir, path, r, nil
+}
+
+// explicitReplacements returns the directory of the stencil with import path base and the replacements in
+// params, a list of alternating parameter names and types.
+func explicitReplacements(exists func(pkg string) (string, bool), base string, params []string) (string, string, replacer, error) {
+	if len(params)%2 != 0 {
+		return "", "", nil, errors.Errorf("expected parameter/type pairs after %s/%s, got %q", base, paramMarker, strings.Join(params, "/"))
+	}
+	r := replacer{}
+	for i := 0; i < len(params); i += 2 {
+		name, typ := params[i], params[i+1]
+		if !token.IsIdentifier(name) && name != "interface" {
+			return "", "", nil, errors.Errorf("invalid parameter name %q", name)
+		}
+		if _, ok := r[name]; ok {
+			return "", "", nil, errors.Errorf("parameter %s substituted more than once", name)
+		}
+		if _, err := parseTypePath(typ); err != nil {
+			return "", "", nil, err
+		}
+		r[name] = typ
+	}
+	dir, ok := exists(base)
+	if !ok {
+		return "", "", nil, errors.Errorf("stencil %s not found", base)
+	}
+	return dir, base, r, nil
+}
+
+// substitutePath replaces the types in the specializations of the stencilled import path pkg using r.
+// This allows a stencil to import another stencil specialized using its own types.
+func substitutePath(pkg, base string, r replacer) string {
+	if rest := strings.TrimPrefix(pkg, base+"/"); strings.HasPrefix(rest, paramMarker+"/") {
+		base += "/" + paramMarker
+	}
+	parts := strings.Split(strings.TrimPrefix(pkg, base+"/"), "/")
+	for i := 1; i < len(parts); i += 2 {
+		toks := strings.Split(parts[i], "~")
+		for j, t := range toks {
+			if rep, ok := r[t]; ok {
+				toks[j] = rep
+			}
+		}
+		parts[i] = strings.Join(toks, "~")
+	}
+	return base + "/" + strings.Join(parts, "/")
+}
+
+// generator generates stencilled packages along with any stencilled packages they import.
+// Generators forked from the same generator share the packages they generate and may be used concurrently.
+type generator struct {
+	ctx context.Context
+	l   layout
+	imp *sourceImporter
+	// dir is the directory of the package importing the stencilled packages.
+	dir  string
+	opts options
+	// done holds the stencilled packages that have been generated.
+	done *registry
+	// pkg is the stencilled package being generated, if any.
+	pkg *generated
+	// stack holds the stencilled import paths being generated, used to detect cycles.
+	stack []string
+}
+
+func newGenerator(l layout, imp *sourceImporter, dir string, opts options) *generator {
+	if opts.fs == nil {
+		opts.fs = newFileSystem(nil, nil)
+	}
+	return &generator{ctx: context.Background(), l: l, imp: imp, dir: dir, opts: opts, done: newRegistry()}
+}
+
+// fork returns a generator sharing the generated packages of g, generating the stencilled packages
+// imported by packages in dir until ctx is cancelled.
+func (g *generator) fork(ctx context.Context, dir string) *generator {
+	f := *g
+	f.ctx, f.dir, f.pkg, f.stack = ctx, dir, nil, nil
+	return &f
+}
+
+// generate generates the package for path if it is a stencilled import path. It returns the import path
+// to use for the generated package and whether path was stencilled.
+func (g *generator) generate(path string) (string, bool, error) {
+	importPath, _, ok, err := g.generateNamed(path)
+	return importPath, ok, err
+}
+
+// generateNamed is like generate, but also returns the name of the generated package.
+func (g *generator) generateNamed(path string) (string, string, bool, error) {
+	spath, ok := g.l.stencil(path)
+	if !ok {
+		return "", "", false, nil
+	}
+	stencil, base, r, err := replacements(g.l.exists, spath)
+	if err != nil || stencil == "" {
+		return "", "", false, err
+	}
+	if err := g.ctx.Err(); err != nil {
+		return "", "", false, err
+	}
+	target, importPath := g.l.target(spath)
+	key := jobKey(stencil, r)
+	if d, ok := g.done.get(target); ok {
+		return g.use(target, d, spath, key, importPath)
+	}
+	for i, p := range g.stack {
+		if p == spath {
+			return "", "", false, errors.Errorf("import cycle in stencilled packages: %s", strings.Join(append(g.stack[i:], spath), " -> "))
+		}
+	}
+	c := *g
+	c.pkg = &generated{spath: spath, key: key}
+	c.stack = append(g.stack[:len(g.stack):len(g.stack)], spath)
+	name, err := c.makeStencilled(stencil, base, target, importPath, r)
+	if err != nil {
+		return "", "", false, err
 	}
-	return dir, r
+	c.pkg.name = name
+	return g.use(target, g.done.add(target, c.pkg), spath, key, importPath)
 }
 
-func makeStencilled(stencil, stencilled string, r replacer, res *[]file) error {
+// use records that the package being generated imports d, the package generated in target for spath
+// from the stencil and substitutions identified by key. It returns the import path and name of d.
+func (g *generator) use(target string, d *generated, spath, key, importPath string) (string, string, bool, error) {
+	if d.key != key {
+		return "", "", false, conflictError(target, d.spath, spath)
+	}
+	if g.pkg != nil {
+		g.pkg.deps = append(g.pkg.deps, target)
+	}
+	return importPath, d.name, true, nil
+}
+
+// rewriteImport rewrites the import of from in f to to. The import is named if name, the name of the
+// imported package, differs from the last element of to.
+func rewriteImport(fs *token.FileSet, f *ast.File, from, to, name string) {
+	for _, imp := range f.Imports {
+		if p := imp.Path.Value; p[1:len(p)-1] == from && imp.Name == nil && name != path.Base(to) {
+			imp.Name = &ast.Ident{Name: name, NamePos: imp.Pos()}
+		}
+	}
+	astutil.RewriteImport(fs, f, from, to)
+}
+
+// generateImports generates stencilled packages imported by f, a file in a stencil specialized using r.
+// Imports of generated packages are rewritten to use the import paths returned by the layout.
+func (g *generator) generateImports(fs *token.FileSet, f *ast.File, r replacer) error {
+	for _, imp := range f.Imports {
+		path := imp.Path.Value
+		path = path[1 : len(path)-1]
+		spath, ok := g.l.stencil(path)
+		if !ok {
+			continue
+		}
+		if _, base, _, _ := replacements(g.l.exists, spath); base != "" {
+			spath = substitutePath(spath, base, r)
+		}
+		importPath, name, ok, err := g.generateNamed(spath)
+		if err != nil {
+			return &Error{Pos: fs.Position(imp.Pos()), Import: path, Err: err}
+		}
+		// The import is named after the stencil, which the code refers to, in case the package is renamed.
+		if ok {
+			rewriteImport(fs, f, path, importPath, name)
+		}
+	}
+	return nil
+}
+
+// makeStencilled generates the stencil in the directory stencil with import path base, specialized using r.
+// The generated package is written to stencilled and imported using importPath. It returns the name of the
+// stencil package, which code importing the generated package without naming the import refers to it by.
+func (g *generator) makeStencilled(stencil, base, stencilled, importPath string, r replacer) (string, error) {
+	paths, err := goFiles(g.opts.fs, stencil, g.opts.tests)
+	if err != nil {
+		return "", err
+	}
+	hash, testHash, err := stencilHashes(g.opts.fs, paths)
+	if err != nil {
+		return "", err
+	}
 	fs := token.NewFileSet()
-	pkgs, err := parser.ParseDir(fs, stencil, func(s os.FileInfo) bool {
-		return !strings.HasSuffix(s.Name(), "_test.go")
-	}, parser.AllErrors|parser.ParseComments)
+	pkgs := map[string]*ast.Package{}
+	for _, p := range paths {
+		b, err := g.opts.fs.ReadFile(p)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		f, err := parser.ParseFile(fs, p, b, parser.AllErrors|parser.ParseComments)
+		if err != nil {
+			return "", errors.Wrapf(err, "%s: errors parsing", stencil)
+		}
+		if pkgs[f.Name.Name] == nil {
+			pkgs[f.Name.Name] = &ast.Package{Name: f.Name.Name, Files: map[string]*ast.File{}}
+		}
+		pkgs[f.Name.Name].Files[p] = f
+	}
+	files, xtests, err := splitTests(stencil, pkgs)
 	if err != nil {
-		return errors.Wrapf(err, "%s: errors parsing", stencil)
+		return "", err
+	}
+	params, defaults, err := stencilParams(files)
+	if err != nil {
+		return "", errors.Wrapf(err, "%s", stencil)
+	}
+	r = r.withDefaults(g.opts.defaults[base].withDefaults(defaults))
+	if len(r) == 0 {
+		return "", errors.Errorf("no types substituted in %s, whose parameters have no defaults", base)
 	}
-	if len(pkgs) != 1 {
-		return errors.Errorf("%d: expected 1 package, got %d", stencil, len(pkgs))
+	if g.opts.permissive {
+		params = nil
+	}
+	name, err := stencilName(g.opts.fs, stencil, paths)
+	if err != nil {
+		return "", err
+	}
+	pkgName := name
+	if n, ok := g.opts.names[g.pkg.spath]; ok {
+		pkgName = n
+	} else if g.opts.rename {
+		if pkgName, err = specializedName(name, r); err != nil {
+			return "", err
+		}
 	}
-	var files map[string]*ast.File
-	for _, p := range pkgs {
+	prov := &Provenance{Stencil: base, Hash: hash, Substitutions: r, Version: Version}
+	testProv := *prov
+	testProv.Hash = testHash
+	provs := provenances{prov, &testProv}
+	if g.opts.cache && cached(g.opts.fs, stencilled, paths, provs, pkgName) {
+		return name, g.generateCached(stencilled, paths, importPath)
+	}
+	pkg, info := checkStencil(fs, specializedImporter{g}, files)
+	s, err := newSubstitution(pkg, info, r, params)
+	if err != nil {
+		return "", err
+	}
+	if err := g.checkConstraints(fs, pkg, info, files, s); err != nil {
+		return "", err
+	}
+	if pkgName != name {
+		s.docs = true
+		for _, f := range pkgs {
+			for _, fl := range f.Files {
+				s.rename(fl, name, pkgName)
+			}
+		}
+	}
+	if err := g.writeFiles(fs, s, provs, stencilled, files, r, nil); err != nil {
+		return "", err
+	}
+	if len(xtests) == 0 {
+		return name, nil
+	}
+	// External tests import the stencil, which is replaced by the type checked stencil so that
+	// identifiers referring to replaced types can be found.
+	_, xinfo := checkStencil(fs, &stencilImporter{path: base, pkg: pkg, sourceImporter: g.imp}, xtests)
+	xs := *s
+	xs.info = xinfo
+	return name, g.writeFiles(fs, &xs, provs, stencilled, xtests, r, map[string]importRewrite{base: {importPath, name}})
+}
+
+// importRewrite is the import path and package name an import is rewritten to.
+type importRewrite struct {
+	path, name string
+}
+
+// splitTests returns the files of the package in pkgs and the files of its external test package, if any.
+func splitTests(stencil string, pkgs map[string]*ast.Package) (map[string]*ast.File, map[string]*ast.File, error) {
+	var files, xtests map[string]*ast.File
+	for name, p := range pkgs {
+		if len(pkgs) == 2 && strings.HasSuffix(name, "_test") {
+			xtests = p.Files
+			continue
+		}
 		files = p.Files
-		break
 	}
-	for path, f := range files {
+	if len(pkgs) == 0 || len(pkgs) > 2 || len(pkgs) == 2 && xtests == nil {
+		return nil, nil, errors.Errorf("%s: expected 1 package, got %d", stencil, len(pkgs))
+	}
+	return files, xtests, nil
+}
+
+// sortedPaths returns the paths of files, sorted.
+func sortedPaths(files map[string]*ast.File) []string {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// writeFiles specializes files of a stencil using s, generating them in stencilled with their provenance in provs.
+// Imports are rewritten using rewrites after any stencilled packages they import are generated.
+func (g *generator) writeFiles(fs *token.FileSet, s *substitution, provs provenances, stencilled string,
+	files map[string]*ast.File, r replacer, rewrites map[string]importRewrite) error {
+	for _, path := range sortedPaths(files) {
+		f := files[path]
 		target := filepath.Join(stencilled, filepath.Base(path))
-		apply.Apply(f, r.preReplace, nil)
+		apply.Apply(f, s.preReplace, nil)
+		s.removeDropped(fs, f)
+		s.addImports(fs, f)
+		if err := g.generateImports(fs, f, r); err != nil {
+			return err
+		}
+		for from, to := range rewrites {
+			rewriteImport(fs, f, from, to.path, to.name)
+		}
 		var b bytes.Buffer
 		if err := format.Node(&b, fs, f); err != nil {
-			return errors.Errorf("%s:%s: code generation failed", stencil, f.Name)
+			return errors.Wrapf(err, "%s: code generation failed", fs.Position(f.Pos()))
 		}
 		out, err := imports.Process(target, b.Bytes(), nil)
 		if err != nil {
-			return errors.WithStack(err)
+			return errors.Wrapf(err, "%s: code generation failed", fs.Position(f.Pos()))
 		}
-		*res = append(*res, file{path: target, data: out})
+		g.pkg.files = append(g.pkg.files, File{Path: target, Data: append(provs.of(target).header(), out...)})
 	}
 	return nil
 }
 
-func srcRoot(dir string) (string, error) {
-	srcs := build.Default.SrcDirs()
+// checkStencil type checks the files of a stencil. Type errors are ignored, since they are commonly caused
+// by imports that cannot be resolved and do not affect identifiers declared in the stencil.
+func checkStencil(fs *token.FileSet, imp types.Importer, files map[string]*ast.File) (*types.Package, *types.Info) {
+	info := &types.Info{
+		Defs: map[*ast.Ident]types.Object{},
+		Uses: map[*ast.Ident]types.Object{},
+	}
+	conf := types.Config{
+		Importer: imp,
+		Error:    func(error) {},
+	}
+	paths := sortedPaths(files)
+	fl := make([]*ast.File, len(paths))
+	for i, p := range paths {
+		fl[i] = files[p]
+	}
+	pkg, _ := conf.Check("stencil", fs, fl, info)
+	return pkg, info
+}
+
+// srcRoot returns the source directory of the GOPATH in ctx that contains dir.
+func srcRoot(v *fileSystem, ctx *build.Context, dir string) (string, error) {
+	srcs := ctx.SrcDirs()
 	for _, src := range srcs {
 		if strings.HasPrefix(dir, src) {
 			return src, nil
@@ -225,7 +806,7 @@ func srcRoot(dir string) (string, error) {
 		if filepath.Base(d) != "src" {
 			continue
 		}
-		info, err := os.Stat(d)
+		info, err := v.Stat(d)
 		if err != nil {
 			return "", errors.Wrapf(err, "failed to stat parent dir: %s", d)
 		}
@@ -233,7 +814,7 @@ func srcRoot(dir string) (string, error) {
 	}
 
 	for _, src := range srcs {
-		si, err := os.Stat(src)
+		si, err := v.Stat(src)
 		if err != nil {
 			return "", errors.Wrapf(err, "couldn't stat Go src folder: %s", src)
 		}
@@ -247,53 +828,245 @@ func srcRoot(dir string) (string, error) {
 	return "", errors.Errorf("%s: not in GOPATH", dir)
 }
 
-func processDir(dir string, files []string, res *[]file) error {
-	// Read files
-	fs := token.NewFileSet()
-	srcs, err := srcRoot(dir)
+// A layout determines where stencils are found and where stencilled packages are generated.
+type layout interface {
+	// stencil returns the stencilled import path referred to by path and whether path refers to one.
+	stencil(path string) (string, bool)
+	// exists returns the directory of pkg, if it exists.
+	exists(pkg string) (string, bool)
+	// target returns the directory a stencilled import path is generated in and
+	// the import path consumers should use for it.
+	target(path string) (dir string, importPath string)
+	// context returns the build context used to locate packages.
+	context() *build.Context
+	// outputDir returns the directory stencilled packages are generated in.
+	outputDir() string
+}
+
+// gopathLayout finds stencils in GOPATH and generates stencilled packages in a vendor directory.
+type gopathLayout struct {
+	fs     *fileSystem
+	ctx    build.Context
+	roots  []string
+	vendor string
+	// out is the directory stencilled packages are generated in. Unless out is a vendor directory,
+	// generated packages are imported using the import path prefix.
+	out, prefix string
+}
+
+// newGopathLayout returns the layout for the package in dir, located using ctx and read from v. Stencilled packages
+// are generated in out, or the directory selected by mode if out is empty.
+func newGopathLayout(v *fileSystem, dir string, ctx build.Context, out string, mode OutputMode) (*gopathLayout, error) {
+	v.setHooks(&ctx)
+	srcs, err := srcRoot(v, &ctx, dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	vendor := filepath.Join(dir, "vendor")
-	for d := dir; d != srcs; d = filepath.Dir(d) {
-		v := filepath.Join(d, "vendor")
-		st, err := os.Stat(d)
+	// srcs is not a parent of dir if it was matched through a symlink, so stop at the filesystem root.
+	for d := dir; d != srcs && d != filepath.Dir(d); d = filepath.Dir(d) {
+		vd := filepath.Join(d, "vendor")
+		st, err := v.Stat(vd)
 		if err == nil && st.IsDir() {
-			vendor = v
+			vendor = vd
 			break
 		}
 	}
-	roots := append(build.Default.SrcDirs(), vendor)
-
-	for _, fl := range files {
-		f, err := parser.ParseFile(fs, fl, nil, parser.ImportsOnly)
+	if out == "" && (mode == RootVendor || mode == GeneratedDir) {
+		root, err := repoRoot(v, dir, srcs)
 		if err != nil {
-			return errors.Wrapf(err, "%s: parse failed", fl)
+			return nil, err
 		}
-		for _, imp := range f.Imports {
-			path := imp.Path.Value
-			path = path[1 : len(path)-1]
-			stencil, r := replacements(roots, path)
-			if stencil == "" {
-				continue
-			}
-			if err = makeStencilled(stencil, filepath.Join(vendor, path), r, res); err != nil {
-				return err
+		if mode == RootVendor {
+			vendor = filepath.Join(root, "vendor")
+		} else {
+			out = filepath.Join(root, moduleGenDir)
+		}
+	}
+	l := &gopathLayout{fs: v, ctx: ctx, roots: append(ctx.SrcDirs(), vendor), vendor: vendor, out: vendor}
+	if out == "" || out == vendor {
+		return l, nil
+	}
+	if l.out, err = filepath.Abs(out); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if filepath.Base(l.out) == "vendor" {
+		return l, nil
+	}
+	src, err := srcRoot(v, &ctx, l.out)
+	if err != nil {
+		return nil, errors.Wrapf(err, "output directory %s", out)
+	}
+	rel, err := filepath.Rel(src, l.out)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	l.prefix = filepath.ToSlash(rel)
+	return l, nil
+}
+
+// vcsDirs are the directories marking the root of a repository.
+var vcsDirs = []string{".git", ".hg", ".svn", ".bzr"}
+
+// repoRoot returns the root of the repository containing dir, a directory in the GOPATH source directory src.
+func repoRoot(v *fileSystem, dir, src string) (string, error) {
+	for d := dir; d != src && d != filepath.Dir(d); d = filepath.Dir(d) {
+		for _, vcs := range vcsDirs {
+			if _, err := v.Stat(filepath.Join(d, vcs)); err == nil {
+				return d, nil
 			}
 		}
 	}
+	return "", errors.Errorf("%s: not in a repository", dir)
+}
+
+// stencil returns the stencilled import path for path, stripping the import path prefix if present.
+func (l *gopathLayout) stencil(path string) (string, bool) {
+	if l.prefix == "" {
+		return path, true
+	}
+	return strings.TrimPrefix(path, l.prefix+"/"), true
+}
+
+func (l *gopathLayout) exists(pkg string) (string, bool) {
+	srcs := l.roots[:len(l.roots)-1]
+	if dir, ok := packageExists(l.fs, srcs, pkg); ok {
+		return dir, true
+	}
+	dir, ok := packageExists(l.fs, []string{l.vendor}, pkg)
+	if !ok {
+		return "", false
+	}
+	// Stencilled packages are generated in the vendor directory, and are known by their provenance. They must
+	// not be mistaken for packages that exist, or they would never be generated again. Directories without Go
+	// files, like the parents of stencilled packages, are not packages.
+	files, err := goFiles(l.fs, dir, false)
+	if err != nil || len(files) == 0 {
+		return "", false
+	}
+	if b, err := l.fs.ReadFile(files[0]); err == nil {
+		if _, ok := ReadProvenance(b); ok {
+			return "", false
+		}
+	}
+	return dir, true
+}
+
+func (l *gopathLayout) target(path string) (string, string) {
+	if l.prefix == "" {
+		return filepath.Join(l.out, path), path
+	}
+	return filepath.Join(l.out, path), l.prefix + "/" + path
+}
+
+func (l *gopathLayout) outputDir() string { return l.out }
+
+func (l *gopathLayout) context() *build.Context {
+	// The file system callbacks set in ctx make go/build search GOPATH instead of using the go command.
+	ctx := l.ctx
+	return &ctx
+}
+
+// newLayout returns the layout for the package in dir, configured by opts.
+func newLayout(dir string, opts options) (layout, error) {
+	ctx := build.Default
+	if opts.buildContext != nil {
+		ctx = *opts.buildContext
+	}
+	mod, err := findModule(opts.fs, dir, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if mod == nil {
+		return newGopathLayout(opts.fs, dir, ctx, opts.outputDir, opts.output)
+	}
+	if opts.outputDir != "" {
+		if err := mod.setOutputDir(opts.outputDir); err != nil {
+			return nil, err
+		}
+		return mod, nil
+	}
+	if opts.output == NearestVendor || opts.output == RootVendor {
+		return nil, errors.Errorf("%s: output mode %s cannot be used in module %s", dir, opts.output, mod.path)
+	}
+	return mod, nil
+}
+
+// rewriteImports rewrites import paths in the Go file at path, read from v, using the old to new import path
+// mapping in rewrites.
+func rewriteImports(v *fileSystem, path string, rewrites map[string]string, res *[]File) error {
+	if len(rewrites) == 0 {
+		return nil
+	}
+	src, err := v.ReadFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	fs := token.NewFileSet()
+	f, err := parser.ParseFile(fs, path, src, parser.ParseComments)
+	if err != nil {
+		return errors.Wrapf(err, "%s: parse failed", path)
+	}
+	for from, to := range rewrites {
+		astutil.RewriteImport(fs, f, from, to)
+	}
+	var b bytes.Buffer
+	if err := format.Node(&b, fs, f); err != nil {
+		return errors.Wrapf(err, "%s: failed to rewrite imports", path)
+	}
+	*res = append(*res, File{Path: path, Data: b.Bytes(), consumer: true})
 	return nil
 }
 
-func processStencil(paths []string) ([]file, error) {
-	dirs, err := listPackages(paths)
+// processStencil returns the files generated for stencilled packages imported by paths. Errors generating
+// stencilled packages are returned as Errors. Generation stops if ctx is cancelled.
+func processStencil(ctx context.Context, paths []string, opts options) ([]File, error) {
+	if opts.fs == nil {
+		opts.fs = newFileSystem(nil, nil)
+	}
+	dirs, err := listPackages(opts.fs, paths, opts.tests)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, errs, err := collectJobs(dirs, opts)
 	if err != nil {
 		return nil, err
 	}
-	var res []file
-	for dir, files := range dirs {
-		if err := processDir(dir, files, &res); err != nil {
+	jerrs, err := runJobs(ctx, jobs, opts)
+	if err != nil {
+		return nil, err
+	}
+	if errs = append(errs, jerrs...); len(errs) != 0 {
+		sort.Sort(errs)
+		return nil, errs
+	}
+
+	var res []File
+	seen := map[string]bool{}
+	// rewrites maps consumer files to the imports in them that are rewritten.
+	rewrites := map[string]map[string]string{}
+	for _, j := range jobs {
+		j.g.done.files(j.target, seen, &res)
+		for _, ref := range j.refs {
+			if j.importPath == ref.path || ref.spec {
+				continue
+			}
+			if rewrites[ref.pos.Filename] == nil {
+				rewrites[ref.pos.Filename] = map[string]string{}
+			}
+			rewrites[ref.pos.Filename][ref.path] = j.importPath
+		}
+	}
+
+	files := make([]string, 0, len(rewrites))
+	for f := range rewrites {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		if err := rewriteImports(opts.fs, f, rewrites[f], &res); err != nil {
 			return nil, err
 		}
 	}
@@ -1,9 +1,15 @@
 package stencil
 
 import (
+	"context"
+	"fmt"
+	"go/build"
 	"path/filepath"
 	"testing"
+	"testing/fstest"
 
+	"go/ast"
+	"go/token"
 	"io/ioutil"
 
 	"flag"
@@ -14,6 +20,8 @@ import (
 
 	"strings"
 
+	"time"
+
 	"github.com/pkg/errors"
 	"github.com/sridharv/fakegopath"
 )
@@ -30,7 +38,9 @@ type testCase struct {
 	files   []fakegopath.SourceFile
 	srcs    []string
 	outs    []outFile
-	process func([]string) ([]file, error)
+	process func([]string) ([]File, error)
+	// err, if set, is a substring of the error expected from process.
+	err string
 }
 
 func (c testCase) run(t *testing.T) {
@@ -47,9 +57,15 @@ func (c testCase) run(t *testing.T) {
 		}
 		proc := c.process
 		if proc == nil {
-			proc = processStencil
+			proc = func(p []string) ([]File, error) { return processStencil(context.Background(), p, options{}) }
 		}
 		files, err := proc(srcs)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("expected error containing %q, got %v", c.err, err)
+			}
+			return
+		}
 		if err != nil {
 			t.Fatalf("%+v", err)
 		}
@@ -59,11 +75,11 @@ func (c testCase) run(t *testing.T) {
 		for i, o := range c.outs {
 			out := filepath.Join(tmp.Src, o.path)
 			f := files[i]
-			if !strings.HasSuffix(f.path, out) {
-				t.Errorf("expected file %s, got %s", out, f.path)
+			if !strings.HasSuffix(f.Path, out) {
+				t.Errorf("expected file %s, got %s", out, f.Path)
 			}
 			if *updateGoldens {
-				if err := ioutil.WriteFile(o.golden, f.data, 0644); err != nil {
+				if err := ioutil.WriteFile(o.golden, f.Data, 0644); err != nil {
 					t.Error(o.golden, ": failed to update golden", err)
 				}
 				continue
@@ -72,13 +88,33 @@ func (c testCase) run(t *testing.T) {
 			if err != nil {
 				t.Fatal(o.golden, ": could not read golden", err)
 			}
-			if !bytes.Equal(golden, f.data) {
-				t.Errorf("expected output:\n%s\ngot:\n%s", string(golden), string(f.data))
+			if !bytes.Equal(golden, f.Data) {
+				t.Errorf("expected output:\n%s\ngot:\n%s", string(golden), string(f.Data))
 			}
 		}
 	})
 }
 
+// migrateStencil returns a process function migrating the stencil with the import path stencil.
+func migrateStencil(stencil string) func([]string) ([]File, error) {
+	return func(p []string) ([]File, error) {
+		return migrate(context.Background(), stencil, p, options{})
+	}
+}
+
+// withDirs returns a process function creating dirs, relative to the directory of the first path,
+// before generating with opts.
+func withDirs(opts Options, dirs ...string) func([]string) ([]File, error) {
+	return func(p []string) ([]File, error) {
+		for _, d := range dirs {
+			if err := os.MkdirAll(filepath.Join(filepath.Dir(p[0]), d), 0755); err != nil {
+				return nil, err
+			}
+		}
+		return NewGenerator(opts).Generate(context.Background(), p)
+	}
+}
+
 var cases = []testCase{
 	{
 		name: "Set_String_SingleFile",
@@ -108,6 +144,21 @@ var cases = []testCase{
 			},
 		},
 	},
+	{
+		name: "Basic_Vendored_Dependency",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/basic.go", Dest: "basic/basic.go"},
+			{Src: "testdata/vendored.go", Dest: "use/vendor/github.com/pkg/errors/errors.go"},
+			{Src: "testdata/vendored.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		outs: []outFile{
+			{
+				path:   "use/vendor/basic/int/float32/basic.go",
+				golden: "testdata/basic.float32.golden",
+			},
+		},
+	},
 	{
 		name: "Set_Interfaces_SingleFile",
 		files: []fakegopath.SourceFile{
@@ -133,7 +184,7 @@ var cases = []testCase{
 		outs: []outFile{
 			{
 				path:   "use/vendor/ifaces/interface/int/interfaces.go",
-				golden: "testdata/interfaces.int.golden",
+				golden: "testdata/interfaces.int.multi.golden",
 			},
 			{
 				path:   "use/vendor/ifaces/interface/int/interfacesintersect.go",
@@ -142,35 +193,1552 @@ var cases = []testCase{
 		},
 	},
 	{
-		name: "Set_String_Dir",
+		name: "Shadowed_String_SingleFile",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/shadow.go", Dest: "shadow/shadow.go"},
+			{Src: "testdata/shadow.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		outs: []outFile{
+			{
+				path:   "use/vendor/shadow/T/string/shadow.go",
+				golden: "testdata/shadow.string.golden",
+			},
+		},
+	},
+	{
+		name: "Set_String_Module",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/mod.gomod", Dest: "mod/go.mod"},
+			{Src: "testdata/set.go", Dest: "mod/collections/set/set.go"},
+			{Src: "testdata/set.intersect.mod.go", Dest: "mod/examples/setexamples/intersect.go"},
+		},
+		srcs: []string{"mod/examples/setexamples/intersect.go"},
+		outs: []outFile{
+			{
+				path:   "mod/generated/example.com/mod/collections/set/Element/string/set.go",
+				golden: "testdata/set.string.mod.golden",
+			},
+			{
+				path:   "mod/examples/setexamples/intersect.go",
+				golden: "testdata/set.intersect.mod.golden",
+			},
+		},
+	},
+	{
+		name: "Set_String_Module_Regenerate",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/mod.gomod", Dest: "mod/go.mod"},
+			{Src: "testdata/set.go", Dest: "mod/collections/set/set.go"},
+			{Src: "testdata/set.intersect.mod.golden", Dest: "mod/examples/setexamples/intersect.go"},
+		},
+		srcs: []string{"mod/examples/setexamples/intersect.go"},
+		outs: []outFile{
+			{
+				path:   "mod/generated/example.com/mod/collections/set/Element/string/set.go",
+				golden: "testdata/set.string.mod.golden",
+			},
+		},
+	},
+	{
+		name: "Set_String_Module_OutputDir",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/mod.gomod", Dest: "mod/go.mod"},
+			{Src: "testdata/set.go", Dest: "mod/collections/set/set.go"},
+			{Src: "testdata/set.intersect.mod.go", Dest: "mod/examples/setexamples/intersect.go"},
+		},
+		srcs: []string{"mod/examples/setexamples/intersect.go"},
+		process: func(p []string) ([]File, error) {
+			out := filepath.Join(filepath.Dir(p[0]), "../../internal/gen")
+			return NewGenerator(Options{OutputDir: out}).Generate(context.Background(), p)
+		},
+		outs: []outFile{
+			{
+				path:   "mod/internal/gen/example.com/mod/collections/set/Element/string/set.go",
+				golden: "testdata/set.string.mod.golden",
+			},
+			{
+				path:   "mod/examples/setexamples/intersect.go",
+				golden: "testdata/set.intersect.mod.outdir.golden",
+			},
+		},
+	},
+	{
+		name: "Set_String_NearestVendor",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/set.go", Dest: "collections/set/set.go"},
+			{Src: "testdata/set.intersect.go", Dest: "repo/examples/setexamples/intersect.go"},
+		},
+		srcs:    []string{"repo/examples/setexamples/intersect.go"},
+		process: withDirs(Options{}, "../../vendor"),
+		outs: []outFile{
+			{
+				path:   "repo/vendor/collections/set/Element/string/set.go",
+				golden: "testdata/set.string.golden",
+			},
+		},
+	},
+	{
+		name: "Set_String_RootVendor",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/set.go", Dest: "collections/set/set.go"},
+			{Src: "testdata/set.intersect.go", Dest: "repo/examples/setexamples/intersect.go"},
+		},
+		srcs:    []string{"repo/examples/setexamples/intersect.go"},
+		process: withDirs(Options{Output: RootVendor}, "../../.git", "../vendor"),
+		outs: []outFile{
+			{
+				path:   "repo/vendor/collections/set/Element/string/set.go",
+				golden: "testdata/set.string.golden",
+			},
+		},
+	},
+	{
+		name: "Set_String_RootVendor_NoRepo",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/set.go", Dest: "collections/set/set.go"},
+			{Src: "testdata/set.intersect.go", Dest: "repo/examples/setexamples/intersect.go"},
+		},
+		srcs:    []string{"repo/examples/setexamples/intersect.go"},
+		process: withDirs(Options{Output: RootVendor}),
+		err:     "examples/setexamples: not in a repository",
+	},
+	{
+		name: "Set_String_GeneratedDir",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/set.go", Dest: "collections/set/set.go"},
+			{Src: "testdata/set.intersect.go", Dest: "repo/examples/setexamples/intersect.go"},
+		},
+		srcs:    []string{"repo/examples/setexamples/intersect.go"},
+		process: withDirs(Options{Output: GeneratedDir}, "../../.git"),
+		outs: []outFile{
+			{
+				path:   "repo/generated/collections/set/Element/string/set.go",
+				golden: "testdata/set.string.golden",
+			},
+			{
+				path:   "repo/examples/setexamples/intersect.go",
+				golden: "testdata/set.intersect.generated.golden",
+			},
+		},
+	},
+	{
+		name: "Set_String_Module_Vendor",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/mod.gomod", Dest: "mod/go.mod"},
+			{Src: "testdata/set.go", Dest: "mod/collections/set/set.go"},
+			{Src: "testdata/set.intersect.mod.go", Dest: "mod/examples/setexamples/intersect.go"},
+		},
+		srcs:    []string{"mod/examples/setexamples/intersect.go"},
+		process: withDirs(Options{Output: NearestVendor}),
+		err:     "output mode vendor cannot be used in module example.com/mod",
+	},
+	{
+		name: "Specializations",
+		files: []fakegopath.SourceFile{
+			{Src: "std/slice/slice.go", Dest: "slice/slice.go"},
+			{Src: "testdata/set.go", Dest: "collections/set/set.go"},
+			{Src: "testdata/app.go", Dest: "app/app.go"},
+		},
+		srcs: []string{"app/app.go"},
+		process: func(p []string) ([]File, error) {
+			dir := filepath.Dir(p[0])
+			return NewGenerator(Options{Specializations: []Specialization{
+				{Stencil: "slice", Substitutions: map[string]string{"T": "int"}, Package: "ints", Dir: dir},
+				{Stencil: "collections/set", Substitutions: map[string]string{"Element": "string"}, Output: "gen", Dir: dir},
+			}}).Generate(context.Background(), p)
+		},
+		outs: []outFile{
+			{
+				path:   "app/vendor/slice/_/T/int/slice.go",
+				golden: "testdata/slice.int.ints.golden",
+			},
+			{
+				path:   "app/gen/collections/set/_/Element/string/set.go",
+				golden: "testdata/set.string.golden",
+			},
+		},
+	},
+	{
+		name: "Specializations_Typo",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/set.go", Dest: "collections/set/set.go"},
+			{Src: "testdata/app.go", Dest: "app/app.go"},
+		},
+		srcs: []string{"app/app.go"},
+		process: func(p []string) ([]File, error) {
+			return NewGenerator(Options{Specializations: []Specialization{
+				{Stencil: "collections/set", Substitutions: map[string]string{"Elemnt": "string"}, Dir: filepath.Dir(p[0])},
+			}}).Generate(context.Background(), p)
+		},
+		err: "collections/set/_/Elemnt/string: no type Elemnt in the stencil, did you mean Element?",
+	},
+	{
+		name: "Set_String_Dedupe",
 		files: []fakegopath.SourceFile{
 			{Src: "testdata/set.go", Dest: "collections/set/set.go"},
 			{Src: "testdata/set.intersect.go", Dest: "examples/setexamples/intersect.go"},
+			{Src: "testdata/set.intersect.go", Dest: "examples/setexamples/intersect2.go"},
 		},
-		srcs: []string{"examples/setexamples/intersect.go"},
+		srcs: []string{"examples/setexamples"},
 		outs: []outFile{
 			{
 				path:   "examples/setexamples/vendor/collections/set/Element/string/set.go",
 				golden: "testdata/set.string.golden",
 			},
 		},
-		process: func(p []string) ([]file, error) {
-			d := filepath.Dir(p[0])
-			cwd, err := os.Getwd()
-			if err != nil {
-				return nil, errors.WithStack(err)
-			}
-			if err = os.Chdir(d); err != nil {
-				return nil, errors.WithStack(err)
-			}
-			defer os.Chdir(cwd)
-			return processStencil([]string{})
+	},
+	{
+		name: "Set_String_Module_Dedupe",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/mod.gomod", Dest: "mod/go.mod"},
+			{Src: "testdata/set.go", Dest: "mod/collections/set/set.go"},
+			{Src: "testdata/set.intersect.mod.go", Dest: "mod/examples/setexamples/intersect.go"},
+			{Src: "testdata/set.intersect.mod.go", Dest: "mod/examples/other/intersect.go"},
+		},
+		srcs: []string{"mod/examples/setexamples", "mod/examples/other"},
+		outs: []outFile{
+			{
+				path:   "mod/generated/example.com/mod/collections/set/Element/string/set.go",
+				golden: "testdata/set.string.mod.golden",
+			},
+			{
+				path:   "mod/examples/other/intersect.go",
+				golden: "testdata/set.intersect.mod.golden",
+			},
+			{
+				path:   "mod/examples/setexamples/intersect.go",
+				golden: "testdata/set.intersect.mod.golden",
+			},
 		},
 	},
-}
-
-func TestStencil(t *testing.T) {
-	for _, c := range cases {
-		c.run(t)
+	{
+		name: "Holder_CompositeTypes",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/holder.go", Dest: "holder/holder.go"},
+			{Src: "testdata/holder.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		outs: []outFile{
+			{
+				path:   "use/vendor/holder/Value/ptr~bytes.Buffer/holder.go",
+				golden: "testdata/holder.ptr.golden",
+			},
+			{
+				path:   "use/vendor/holder/Value/map~string~slice~domain+user.ID/holder.go",
+				golden: "testdata/holder.map.golden",
+			},
+			{
+				path:   "use/vendor/holder/Value/recvchan~int/holder.go",
+				golden: "testdata/holder.chan.golden",
+			},
+		},
+	},
+	{
+		name: "SliceSet_String_Transitive",
+		files: []fakegopath.SourceFile{
+			{Src: "std/slice/slice.go", Dest: "slice/slice.go"},
+			{Src: "testdata/sliceset.go", Dest: "sliceset/sliceset.go"},
+			{Src: "testdata/sliceset.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		outs: []outFile{
+			{
+				path:   "use/vendor/slice/T/string/slice.go",
+				golden: "testdata/slice.string.golden",
+			},
+			{
+				path:   "use/vendor/sliceset/Element/string/sliceset.go",
+				golden: "testdata/sliceset.string.golden",
+			},
+		},
+	},
+	{
+		name: "Pair_Explicit",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/pair.go", Dest: "pair/pair.go"},
+			{Src: "testdata/pair.collision.go", Dest: "pair/K/string/string.go"},
+			{Src: "testdata/pair.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		outs: []outFile{
+			{
+				path:   "use/vendor/pair/_/K/string/V/int/pair.go",
+				golden: "testdata/pair.string.int.golden",
+			},
+		},
+	},
+	{
+		name: "Pair_Explicit_Typo",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/pair.go", Dest: "pair/pair.go"},
+			{Src: "testdata/pair.typo.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		err:  "pair/_/K/string/Value/int: no type Value in the stencil",
+	},
+	{
+		name: "Set_Typo",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/set.go", Dest: "collections/set/set.go"},
+			{Src: "testdata/set.typo.go", Dest: "examples/setexamples/intersect.go"},
+		},
+		srcs: []string{"examples/setexamples/intersect.go"},
+		err:  "collections/set/Elemnt/string: no type Elemnt in the stencil, did you mean Element?",
+	},
+	{
+		name: "Set_Unused_Predeclared",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/set.go", Dest: "collections/set/set.go"},
+			{Src: "testdata/set.unused.go", Dest: "examples/setexamples/has.go"},
+		},
+		srcs: []string{"examples/setexamples/has.go"},
+		err:  "collections/set/bool/int: no type bool in the stencil",
+	},
+	{
+		name: "Grouped_Types",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/grouped.go", Dest: "grouped/grouped.go"},
+			{Src: "testdata/grouped.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		outs: []outFile{
+			{
+				path:   "use/vendor/grouped/Key/string/Value/int/grouped.go",
+				golden: "testdata/grouped.string.int.golden",
+			},
+		},
+	},
+	{
+		name: "Grouped_Types_NotFirst",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/grouped.go", Dest: "grouped/grouped.go"},
+			{Src: "testdata/grouped.value.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		outs: []outFile{
+			{
+				path:   "use/vendor/grouped/Value/int/grouped.go",
+				golden: "testdata/grouped.int.golden",
+			},
+		},
+	},
+	{
+		name: "SliceSet_String_Renamed",
+		files: []fakegopath.SourceFile{
+			{Src: "std/slice/slice.go", Dest: "slice/slice.go"},
+			{Src: "testdata/sliceset.renamed.go", Dest: "sliceset/sliceset.go"},
+			{Src: "testdata/sliceset.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		process: func(p []string) ([]File, error) {
+			return processStencil(context.Background(), p, options{rename: true})
+		},
+		outs: []outFile{
+			{
+				path:   "use/vendor/slice/T/string/slice.go",
+				golden: "testdata/slice.string.renamed.golden",
+			},
+			{
+				path:   "use/vendor/sliceset/Element/string/sliceset.go",
+				golden: "testdata/sliceset.string.renamed.golden",
+			},
+		},
+	},
+	{
+		name: "Annotated_Params",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/annotated.go", Dest: "annotated/annotated.go"},
+			{Src: "testdata/annotated.params.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		outs: []outFile{
+			{
+				path:   "use/vendor/annotated/_/K/string/V/int/annotated.go",
+				golden: "testdata/annotated.string.int.golden",
+			},
+		},
+	},
+	{
+		name: "Annotated_NotParam",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/annotated.go", Dest: "annotated/annotated.go"},
+			{Src: "testdata/annotated.notparam.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		err:  "annotated/_/Count/int64: Count is not a parameter of the stencil, whose parameters are K, V",
+	},
+	{
+		name: "Annotated_NotParam_Permissive",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/annotated.go", Dest: "annotated/annotated.go"},
+			{Src: "testdata/annotated.notparam.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		process: func(p []string) ([]File, error) {
+			return NewGenerator(Options{Permissive: true}).Generate(context.Background(), p)
+		},
+		outs: []outFile{
+			{
+				path:   "use/vendor/annotated/_/Count/int64/annotated.go",
+				golden: "testdata/annotated.count.int64.golden",
+			},
+		},
+	},
+	{
+		name: "Annotated_Typo",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/annotated.go", Dest: "annotated/annotated.go"},
+			{Src: "testdata/annotated.typo.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		err:  "annotated/_/Vv/int: no type Vv in the stencil, did you mean V?",
+	},
+	{
+		name: "Defaults_Partial",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/defaulted.go", Dest: "defaulted/defaulted.go"},
+			{Src: "testdata/defaulted.partial.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		outs: []outFile{
+			{
+				path:   "use/vendor/defaulted/V/float64/defaulted.go",
+				golden: "testdata/defaulted.string.float64.golden",
+			},
+		},
+	},
+	{
+		name: "Defaults_All",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/defaulted.go", Dest: "defaulted/defaulted.go"},
+			{Src: "testdata/defaulted.all.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		outs: []outFile{
+			{
+				path:   "use/vendor/defaulted/_/defaulted.go",
+				golden: "testdata/defaulted.string.int.golden",
+			},
+		},
+	},
+	{
+		name: "Defaults_Options",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/defaulted.go", Dest: "defaulted/defaulted.go"},
+			{Src: "testdata/defaulted.partial.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		process: func(p []string) ([]File, error) {
+			opts := Options{Defaults: map[string]map[string]string{"defaulted": {"K": "int64"}}}
+			return NewGenerator(opts).Generate(context.Background(), p)
+		},
+		outs: []outFile{
+			{
+				path:   "use/vendor/defaulted/V/float64/defaulted.go",
+				golden: "testdata/defaulted.int64.float64.golden",
+			},
+		},
+	},
+	{
+		name: "Defaults_None",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/annotated.go", Dest: "annotated/annotated.go"},
+			{Src: "testdata/annotated.nodefaults.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		err:  "no types substituted in annotated, whose parameters have no defaults",
+	},
+	{
+		name: "Migrate_Slice",
+		files: []fakegopath.SourceFile{
+			{Src: "std/slice/slice.go", Dest: "slice/slice.go"},
+			{Src: "testdata/migrate.slice.use.go", Dest: "use/use.go"},
+		},
+		srcs:    []string{"use/use.go"},
+		process: migrateStencil("slice"),
+		outs: []outFile{
+			{path: "slice/slice.go", golden: "testdata/slice.migrated.golden"},
+			{path: "use/use.go", golden: "testdata/migrate.slice.use.golden"},
+		},
+	},
+	{
+		name: "Migrate_Num",
+		files: []fakegopath.SourceFile{
+			{Src: "std/num/num.go", Dest: "num/num.go"},
+			{Src: "testdata/migrate.num.use.go", Dest: "use/use.go"},
+		},
+		srcs:    []string{"use/use.go"},
+		process: migrateStencil("num"),
+		outs: []outFile{
+			{path: "num/num.go", golden: "testdata/num.migrated.golden"},
+			{path: "use/use.go", golden: "testdata/migrate.num.use.golden"},
+		},
+	},
+	{
+		name: "Migrate_Annotated",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/annotated.go", Dest: "annotated/annotated.go"},
+			{Src: "testdata/migrate.annotated.use.go", Dest: "use/use.go"},
+		},
+		srcs:    []string{"use/use.go"},
+		process: migrateStencil("annotated"),
+		outs: []outFile{
+			{path: "annotated/annotated.go", golden: "testdata/annotated.migrated.golden"},
+			{path: "use/use.go", golden: "testdata/migrate.annotated.use.golden"},
+		},
+	},
+	{
+		name: "Migrate_Methods",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/sorted.go", Dest: "sorted/sorted.go"},
+			{Src: "testdata/version.go", Dest: "domain/version/version.go"},
+			{Src: "testdata/sorted.use.go", Dest: "use/use.go"},
+		},
+		srcs:    []string{"use/use.go"},
+		process: migrateStencil("sorted"),
+		outs: []outFile{
+			{path: "sorted/sorted.go", golden: "testdata/sorted.migrated.golden"},
+			{path: "use/use.go", golden: "testdata/migrate.sorted.use.golden"},
+		},
+	},
+	{
+		name: "Migrate_NoParams",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/version.go", Dest: "domain/version/version.go"},
+			{Src: "testdata/sorted.use.go", Dest: "use/use.go"},
+		},
+		srcs:    []string{"use/use.go"},
+		process: migrateStencil("domain/version"),
+		err:     "no parameters to migrate",
+	},
+	{
+		name: "Migrate_Vendored",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/annotated.go", Dest: "use/vendor/annotated/annotated.go"},
+			{Src: "testdata/migrate.annotated.use.go", Dest: "use/use.go"},
+		},
+		srcs:    []string{"use/use.go"},
+		process: migrateStencil("annotated"),
+		err:     "cannot be migrated, since they are not part of the main module or a GOPATH workspace",
+	},
+	{
+		name: "Migrate_Tests",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/stack.go", Dest: "stack/stack.go"},
+			{Src: "testdata/stack.internal_test.go", Dest: "stack/stack_test.go"},
+			{Src: "testdata/stack.external_test.go", Dest: "stack/stack_x_test.go"},
+			{Src: "testdata/stack.use_test.go", Dest: "use/use_test.go"},
+		},
+		srcs:    []string{"use/use_test.go"},
+		process: migrateStencil("stack"),
+		err:     "stack: stencils with tests cannot be migrated, remove or convert stack_test.go, stack_x_test.go first",
+	},
+	{
+		name: "Cycle",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/cycle.a.go", Dest: "a/a.go"},
+			{Src: "testdata/cycle.b.go", Dest: "b/b.go"},
+			{Src: "testdata/cycle.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		err:  "import cycle in stencilled packages: a/T/int -> b/T/int -> a/T/int",
+	},
+	{
+		name: "Sorted_Constraint",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/sorted.go", Dest: "sorted/sorted.go"},
+			{Src: "testdata/version.go", Dest: "domain/version/version.go"},
+			{Src: "testdata/sorted.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		outs: []outFile{
+			{
+				path:   "use/vendor/sorted/T/domain+version.V/sorted.go",
+				golden: "testdata/sorted.version.golden",
+			},
+		},
+	},
+	{
+		name: "Sorted_Constraint_MissingMethod",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/sorted.go", Dest: "sorted/sorted.go"},
+			{Src: "testdata/sorted.int.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		err:  "use/use.go:4:2: sorted/T/int: int does not satisfy sorted.T: missing method Less(int) bool",
+	},
+	{
+		name: "Sorted_Constraint_WrongType",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/sorted.go", Dest: "sorted/sorted.go"},
+			{Src: "testdata/version.go", Dest: "domain/version/version.go"},
+			{Src: "testdata/sorted.name.use.go", Dest: "use/use.go"},
+		},
+		srcs: []string{"use/use.go"},
+		err: "version.Name does not satisfy sorted.T: wrong type for method Less: " +
+			"have func(o string) bool, want func(version.Name) bool",
+	},
+	{
+		name: "Stack_Int_Tests",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/stack.go", Dest: "stack/stack.go"},
+			{Src: "testdata/stack.internal_test.go", Dest: "stack/stack_test.go"},
+			{Src: "testdata/stack.external_test.go", Dest: "stack/stack_x_test.go"},
+			{Src: "testdata/stack.use_test.go", Dest: "use/use_test.go"},
+		},
+		srcs: []string{"use"},
+		outs: []outFile{
+			{
+				path:   "use/vendor/stack/T/int/stack.go",
+				golden: "testdata/stack.int.golden",
+			},
+			{
+				path:   "use/vendor/stack/T/int/stack_test.go",
+				golden: "testdata/stack.int.internal_test.golden",
+			},
+			{
+				path:   "use/vendor/stack/T/int/stack_x_test.go",
+				golden: "testdata/stack.int.external_test.golden",
+			},
+		},
+		process: func(p []string) ([]File, error) { return processStencil(context.Background(), p, options{tests: true}) },
+	},
+	{
+		name: "Stack_Int_NoTests",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/stack.go", Dest: "stack/stack.go"},
+			{Src: "testdata/stack.internal_test.go", Dest: "stack/stack_test.go"},
+			{Src: "testdata/stack.use_test.go", Dest: "use/use_test.go"},
+		},
+		srcs: []string{"use"},
+	},
+	{
+		name: "Set_String_Dir",
+		files: []fakegopath.SourceFile{
+			{Src: "testdata/set.go", Dest: "collections/set/set.go"},
+			{Src: "testdata/set.intersect.go", Dest: "examples/setexamples/intersect.go"},
+		},
+		srcs: []string{"examples/setexamples/intersect.go"},
+		outs: []outFile{
+			{
+				path:   "examples/setexamples/vendor/collections/set/Element/string/set.go",
+				golden: "testdata/set.string.golden",
+			},
+		},
+		process: func(p []string) ([]File, error) {
+			d := filepath.Dir(p[0])
+			cwd, err := os.Getwd()
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if err = os.Chdir(d); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			defer os.Chdir(cwd)
+			return processStencil(context.Background(), []string{}, options{})
+		},
+	},
+}
+
+func TestStencil(t *testing.T) {
+	for _, c := range cases {
+		c.run(t)
+	}
+}
+
+func TestParseTypePath(t *testing.T) {
+	valid := []struct {
+		seg, expr string
+		imports   map[string]string
+	}{
+		{seg: "int", expr: "int"},
+		{seg: "time.Duration", expr: "time.Duration", imports: map[string]string{"time": "time"}},
+		{seg: "ptr~bytes.Buffer", expr: "*bytes.Buffer", imports: map[string]string{"bytes": "bytes"}},
+		{seg: "slice~byte", expr: "[]byte"},
+		{seg: "array~4~int", expr: "[4]int"},
+		{seg: "map~string~slice~int", expr: "map[string][]int"},
+		{seg: "chan~recvchan~int", expr: "chan (<-chan int)"},
+		{seg: "sendchan~error", expr: "chan<- error"},
+		{
+			seg:     "map~gopkg.in+yaml.v2.Kind~ptr~github.com+foo+go-bar.Baz",
+			expr:    "map[yaml.Kind]*go_bar.Baz",
+			imports: map[string]string{"gopkg.in/yaml.v2": "yaml", "github.com/foo/go-bar": "go_bar"},
+		},
+	}
+	for _, v := range valid {
+		tp, err := parseTypePath(v.seg)
+		if err != nil {
+			t.Errorf("%s: %+v", v.seg, err)
+			continue
+		}
+		if tp.expr != v.expr {
+			t.Errorf("%s: expected %s, got %s", v.seg, v.expr, tp.expr)
+		}
+		if len(tp.imports) != len(v.imports) {
+			t.Errorf("%s: expected imports %v, got %v", v.seg, v.imports, tp.imports)
+		}
+		for p, n := range v.imports {
+			if tp.imports[p] != n {
+				t.Errorf("%s: expected %s imported as %s, got %s", v.seg, p, n, tp.imports[p])
+			}
+		}
+	}
+
+	for _, seg := range []string{"", "ptr", "map~int", "array~n~int", "slice~int~int", "time.duration", "1int", ".Foo"} {
+		if _, err := parseTypePath(seg); err == nil {
+			t.Errorf("%q: expected error", seg)
+		}
+	}
+}
+
+func TestReplacements(t *testing.T) {
+	exists := func(pkg string) (string, bool) {
+		switch pkg {
+		case "pair", "pair/K/string":
+			return "/src/" + pkg, true
+		}
+		return "", false
+	}
+	valid := []struct {
+		pkg, base string
+		r         replacer
+	}{
+		{pkg: "pair/K/int", base: "pair", r: replacer{"K": "int"}},
+		{pkg: "pair/_/K/string/V/int", base: "pair", r: replacer{"K": "string", "V": "int"}},
+		{pkg: "pair/_/V/slice~byte", base: "pair", r: replacer{"V": "slice~byte"}},
+		// The implicit syntax stops at the first package that exists.
+		{pkg: "pair/K/string/V/int", base: "pair/K/string", r: replacer{"V": "int"}},
+		{pkg: "pair/K/string"},
+		{pkg: "other/K/int"},
+	}
+	for _, v := range valid {
+		_, base, r, err := replacements(exists, v.pkg)
+		if err != nil {
+			t.Errorf("%s: %+v", v.pkg, err)
+			continue
+		}
+		if base != v.base || len(r) != len(v.r) {
+			t.Errorf("%s: expected %s %v, got %s %v", v.pkg, v.base, v.r, base, r)
+			continue
+		}
+		for k, typ := range v.r {
+			if r[k] != typ {
+				t.Errorf("%s: expected %s=%s, got %s", v.pkg, k, typ, r[k])
+			}
+		}
+	}
+
+	invalid := map[string]string{
+		"pair/_/K":              "expected parameter/type pairs",
+		"pair/_/K/string/V":     "expected parameter/type pairs",
+		"pair/_/K/string/K/int": "parameter K substituted more than once",
+		"pair/_/1K/string":      "invalid parameter name",
+		"pair/_/K/map~int":      "map",
+		"other/_/K/string":      "stencil other not found",
+	}
+	for pkg, msg := range invalid {
+		if _, _, _, err := replacements(exists, pkg); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expected error containing %q, got %v", pkg, msg, err)
+		}
+	}
+}
+
+func TestSpecializedName(t *testing.T) {
+	for _, c := range []struct {
+		r    replacer
+		name string
+	}{
+		{replacer{"T": "int"}, "intslice"},
+		{replacer{"T": "ptr~bytes.Buffer"}, "bufferslice"},
+		{replacer{"T": "map~string~example.com+user.ID"}, "mapstringidslice"},
+		{replacer{"T": "array~4~int"}, "intslice"},
+		{replacer{"V": "int", "K": "string"}, "stringintslice"},
+	} {
+		name, err := specializedName("slice", c.r)
+		if err != nil {
+			t.Errorf("%v: %+v", c.r, err)
+			continue
+		}
+		if name != c.name {
+			t.Errorf("%v: expected %s, got %s", c.r, c.name, name)
+		}
+	}
+}
+
+func TestRenameComment(t *testing.T) {
+	names := map[string]string{"T": "int", "Element": "time.Duration"}
+	for _, c := range []struct{ text, want string }{
+		{"// Package slice implements operations on slices.", "// Package intslice implements operations on slices."},
+		{"// All operations act on slices of T.", "// All operations act on slices of int."},
+		{"// Set is a set of type Element, or Elements.", "// Set is a set of type time.Duration, or Elements."},
+		{"// Import std/slice/T/string or slice.T.", "// Import std/slice/T/string or slice.T."},
+		{"//\tvar s []T", "//\tvar s []T"},
+		{"/* Less reports whether T\n sorts first. */", "/* Less reports whether int\n sorts first. */"},
+	} {
+		if got := renameComment(c.text, "slice", "intslice", names); got != c.want {
+			t.Errorf("expected %q, got %q", c.want, got)
+		}
+	}
+}
+
+func TestParamDefault(t *testing.T) {
+	for text, want := range map[string]string{
+		"//stencil:param":                          "",
+		"//stencil:param default=string":           "",
+		"//stencil:param default=ptr~bytes.Buffer": "",
+		"//stencil:param default=map~int":          "map",
+		"//stencil:param string":                   "unknown option",
+	} {
+		def, err := paramDefault(&ast.Comment{Text: text})
+		if want == "" {
+			if err != nil || def != strings.TrimPrefix(strings.TrimPrefix(text, paramDirective), " "+defaultOption) {
+				t.Errorf("%s: got default %q, %v", text, def, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected error containing %q, got %v", text, want, err)
+		}
+	}
+}
+
+func TestVarFuncs(t *testing.T) {
+	funcs := map[string]string{"Zero": "func Zero[T any]() T", "Zeros": "func Zeros[T any]() []T"}
+	for src, expected := range map[string]string{
+		"package v\n\n// Zero is zero.\nvar Zero T\nvar x = 1\n": "package v\n\n\n// Zero is zero.\n" +
+			"func Zero[T any]() T {\n\tvar Zero T\n\treturn Zero\n}\n\nvar x = 1\n",
+		"package v\n\nvar (\n\t// Zeros are zeros.\n\tZeros []T // trailing\n\tx = 1\n)\n": "package v\n\nvar (\n\tx = 1\n)\n\n" +
+			"// Zeros are zeros.\nfunc Zeros[T any]() []T {\n\tvar Zeros []T // trailing\n\treturn Zeros\n}\n",
+	} {
+		got, err := varFuncs([]byte(src), funcs)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if string(got) != expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", src, expected, got)
+		}
+	}
+}
+
+func TestSubstitutePath(t *testing.T) {
+	r := replacer{"T": "string"}
+	for pkg, expected := range map[string]string{
+		"slice/T/T":          "slice/T/string",
+		"pair/_/K/T/V/ptr~T": "pair/_/K/string/V/ptr~string",
+		"pair/_/T/T":         "pair/_/T/string",
+	} {
+		if got := substitutePath(pkg, strings.SplitN(pkg, "/", 2)[0], r); got != expected {
+			t.Errorf("%s: expected %s, got %s", pkg, expected, got)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tmp, err := fakegopath.NewTemporaryWithFiles("stencil_check", []fakegopath.SourceFile{
+		{Src: "testdata/interfaces.go", Dest: "ifaces/interfaces.go"},
+		{Src: "testdata/interfacesintersect.go", Dest: "ifaces/interfacesintersect.go"},
+		{Src: "testdata/interfaces.use.go", Dest: "use/use.go"},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer tmp.Reset()
+
+	src := filepath.Join(tmp.Src, "use/use.go")
+	gen := filepath.Join(tmp.Src, "use/vendor/ifaces/interface/int")
+	check := func(expected Drift) {
+		d, err := Check([]string{src}, false)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		for _, c := range []struct {
+			name      string
+			got, want []string
+		}{
+			{"stale", d.Stale, expected.Stale},
+			{"missing", d.Missing, expected.Missing},
+			{"orphaned", d.Orphaned, expected.Orphaned},
+		} {
+			if strings.Join(c.got, ",") != strings.Join(c.want, ",") {
+				t.Errorf("expected %s files %v, got %v", c.name, c.want, c.got)
+			}
+		}
+		if d.Empty() != (len(expected.Stale)+len(expected.Missing)+len(expected.Orphaned) == 0) {
+			t.Errorf("unexpected Empty() for %+v", d)
+		}
+	}
+
+	files, err := Generate([]string{src}, false)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expected 2 generated files, got %d", len(files))
+	}
+	check(Drift{Missing: []string{filepath.Join(gen, "interfaces.go"), filepath.Join(gen, "interfacesintersect.go")}})
+	if err := Process([]string{src}, false); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check(Drift{})
+
+	// Edited files keep their provenance, which marks the package as generated.
+	b, err := ioutil.ReadFile(filepath.Join(gen, "interfaces.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(gen, "interfaces.go"), append(b, "\n// Edited.\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(gen, "interfacesintersect.go")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(gen, "old.go"), []byte("package ifaces\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check(Drift{
+		Stale:    []string{filepath.Join(gen, "interfaces.go")},
+		Missing:  []string{filepath.Join(gen, "interfacesintersect.go")},
+		Orphaned: []string{filepath.Join(gen, "old.go")},
+	})
+}
+
+func TestErrors(t *testing.T) {
+	tmp, err := fakegopath.NewTemporaryWithFiles("stencil_errors", []fakegopath.SourceFile{
+		{Src: "testdata/sorted.go", Dest: "sorted/sorted.go"},
+		{Src: "testdata/sorted.multi.use.go", Dest: "use/use.go"},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer tmp.Reset()
+
+	src := filepath.Join(tmp.Src, "use/use.go")
+	_, err = processStencil(context.Background(), []string{src}, options{})
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("expected Errors, got %+v", err)
+	}
+	expected := []struct {
+		line   int
+		imp    string
+		suffix string
+	}{
+		{4, "sorted/T/int", "int does not satisfy sorted.T: missing method Less(int) bool"},
+		{5, "sorted/T/string", "string does not satisfy sorted.T: missing method Less(string) bool"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(errs), errs)
+	}
+	for i, e := range expected {
+		got := errs[i]
+		if got.Pos.Filename != src || got.Pos.Line != e.line || got.Pos.Column != 2 {
+			t.Errorf("expected error at %s:%d:2, got %s", src, e.line, got.Pos)
+		}
+		if got.Import != e.imp {
+			t.Errorf("expected import %s, got %s", e.imp, got.Import)
+		}
+		if !strings.HasSuffix(got.Error(), e.suffix) {
+			t.Errorf("expected error ending with %q, got %q", e.suffix, got.Error())
+		}
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	p := &Provenance{
+		Stencil:       "github.com/sridharv/stencil/std/slice",
+		Hash:          "sha256:0123",
+		Substitutions: map[string]string{"T": "int", "K": "map~string~int"},
+		Version:       Version,
+	}
+	data := append(p.header(), []byte("// Package slice implements operations on slices.\npackage slice\n")...)
+	got, ok := ReadProvenance(data)
+	if !ok {
+		t.Fatalf("expected provenance in:\n%s", data)
+	}
+	if got.Stencil != p.Stencil || got.Hash != p.Hash || got.Version != p.Version {
+		t.Errorf("expected %+v, got %+v", p, got)
+	}
+	if len(got.Substitutions) != 2 || got.Substitutions["T"] != "int" || got.Substitutions["K"] != "map~string~int" {
+		t.Errorf("expected substitutions %v, got %v", p.Substitutions, got.Substitutions)
+	}
+	if _, ok := ReadProvenance([]byte("package slice\n")); ok {
+		t.Error("expected no provenance for a file not generated by stencil")
+	}
+}
+
+func TestClean(t *testing.T) {
+	tmp, err := fakegopath.NewTemporaryWithFiles("stencil_clean", []fakegopath.SourceFile{
+		{Src: "testdata/set.go", Dest: "collections/set/set.go"},
+		{Src: "testdata/set.intersect.go", Dest: "examples/setexamples/intersect.go"},
+		{Src: "testdata/interfaces.go", Dest: "ifaces/interfaces.go"},
+		{Src: "testdata/interfaces.use.go", Dest: "examples/setexamples/use/use.go"},
+		{Src: "testdata/basic.go", Dest: "examples/setexamples/use/vendor/basic/basic.go"},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer tmp.Reset()
+
+	root := filepath.Join(tmp.Src, "examples/setexamples")
+	if err := Process([]string{root + "/..."}, false); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	vendor := filepath.Join(root, "use/vendor")
+	used := filepath.Join(root, "vendor/collections/set/Element/string/set.go")
+	unused := filepath.Join(vendor, "ifaces/interface/int/interfaces.go")
+	for _, p := range []string{used, unused} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("expected %s to be generated: %v", p, err)
+		}
+	}
+
+	// Stop importing the int set.
+	if err := ioutil.WriteFile(filepath.Join(root, "use/use.go"), []byte("package use\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := Clean([]string{root + "/..."}, true)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(removed) != 1 || removed[0] != unused {
+		t.Fatalf("expected %s to be removed, got %v", unused, removed)
+	}
+	if _, err := os.Stat(unused); err != nil {
+		t.Errorf("expected dry run to keep %s: %v", unused, err)
+	}
+	// Check reports the files Clean would remove.
+	d, err := Check([]string{root + "/..."}, false)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(d.Orphaned) != 1 || d.Orphaned[0] != unused {
+		t.Errorf("expected %s to be orphaned, got %+v", unused, d)
+	}
+
+	if _, err := Clean([]string{root + "/..."}, false); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for p, exists := range map[string]bool{
+		used:   true,
+		unused: false,
+		filepath.Join(vendor, "ifaces/interface"): false,
+		filepath.Join(vendor, "ifaces"):           false,
+		filepath.Join(vendor, "basic/basic.go"):   true,
+	} {
+		if _, err := os.Stat(p); (err == nil) != exists {
+			t.Errorf("%s: expected exists=%v, got error %v", p, exists, err)
+		}
+	}
+}
+
+func TestTestsProvenance(t *testing.T) {
+	tmp, err := fakegopath.NewTemporaryWithFiles("stencil_tests_provenance", []fakegopath.SourceFile{
+		{Src: "testdata/stack.go", Dest: "stack/stack.go"},
+		{Src: "testdata/stack.internal_test.go", Dest: "stack/stack_test.go"},
+		{Src: "testdata/stack.use.go", Dest: "use/use.go"},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer tmp.Reset()
+
+	src := []string{filepath.Join(tmp.Src, "use")}
+	if _, err := NewGenerator(Options{Tests: true}).Process(context.Background(), src); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	// Generating tests leaves the other generated files as they would be without them.
+	d, err := Check(src, false)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !d.Empty() {
+		t.Errorf("expected no drift without tests, got %+v", d)
+	}
+	files, err := NewGenerator(Options{}).Process(context.Background(), src)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected nothing written without tests, got %v", files)
+	}
+}
+
+func TestCache(t *testing.T) {
+	tmp, err := fakegopath.NewTemporaryWithFiles("stencil_cache", []fakegopath.SourceFile{
+		{Src: "std/slice/slice.go", Dest: "slice/slice.go"},
+		{Src: "testdata/sliceset.go", Dest: "sliceset/sliceset.go"},
+		{Src: "testdata/sliceset.use.go", Dest: "use/use.go"},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer tmp.Reset()
+
+	use := filepath.Join(tmp.Src, "use/use.go")
+	outer := filepath.Join(tmp.Src, "use/vendor/sliceset/Element/string/sliceset.go")
+	inner := filepath.Join(tmp.Src, "use/vendor/slice/T/string/slice.go")
+	if err := Process([]string{use}, false); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// Mark the generated files, so that regenerating them can be detected.
+	mark := func(p string) {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, append(b, "// marked\n"...), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	marked := func(p string) bool {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.HasSuffix(b, []byte("// marked\n"))
+	}
+	mark(outer)
+	mark(inner)
+
+	if err := Process([]string{use}, false); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !marked(outer) || !marked(inner) {
+		t.Fatal("expected unchanged stencilled packages not to be regenerated")
+	}
+
+	// Changing the inner stencil regenerates it, even though the outer stencil is unchanged.
+	slice := filepath.Join(tmp.Src, "slice/slice.go")
+	b, err := ioutil.ReadFile(slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(slice, append(b, "\nfunc Nop() {}\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Process([]string{use}, false); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !marked(outer) {
+		t.Error("expected the unchanged outer stencil not to be regenerated")
+	}
+	if marked(inner) {
+		t.Error("expected the changed inner stencil to be regenerated")
+	}
+
+	// Check ignores the cache.
+	d, err := Check([]string{use}, false)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(d.Stale) != 1 || d.Stale[0] != outer {
+		t.Errorf("expected %s to be stale, got %+v", outer, d)
+	}
+
+	// Renaming packages regenerates them.
+	mark(inner)
+	if _, err := NewGenerator(Options{Rename: true}).Process(context.Background(), []string{use}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if marked(inner) {
+		t.Error("expected the renamed stencilled package to be regenerated")
+	}
+}
+
+// sameTarget is a layout generating all stencilled packages in the same directory.
+type sameTarget struct {
+	*gopathLayout
+}
+
+func (l sameTarget) target(path string) (string, string) {
+	return filepath.Join(l.vendor, "same"), path
+}
+
+func TestConflict(t *testing.T) {
+	tmp, err := fakegopath.NewTemporaryWithFiles("stencil_conflict", []fakegopath.SourceFile{
+		{Src: "testdata/holder.go", Dest: "holder/holder.go"},
+		{Src: "testdata/holder.use.go", Dest: "use/use.go"},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer tmp.Reset()
+
+	dir := filepath.Join(tmp.Src, "use")
+	l, err := newGopathLayout(newFileSystem(nil, nil), dir, build.Default, "", DefaultOutput)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	g := newGenerator(sameTarget{l}, newSourceImporter(l.context(), token.NewFileSet(), l.fs), dir, options{})
+	for _, p := range []string{"holder/Value/int", "holder/Value/int"} {
+		if _, _, err := g.generate(p); err != nil {
+			t.Fatalf("%s: %+v", p, err)
+		}
+	}
+	var res []File
+	g.done.files(filepath.Join(l.vendor, "same"), map[string]bool{}, &res)
+	if len(res) != 1 {
+		t.Errorf("expected holder/Value/int to be generated once, got %d files", len(res))
+	}
+	_, _, err = g.generate("holder/Value/string")
+	if err == nil || !strings.Contains(err.Error(), "conflicting stencilled packages holder/Value/int and holder/Value/string") {
+		t.Errorf("expected conflict, got %v", err)
+	}
+}
+
+func TestImportError(t *testing.T) {
+	tmp, err := fakegopath.NewTemporaryWithFiles("stencil_import", []fakegopath.SourceFile{
+		{Src: "testdata/holder.go", Dest: "holder/holder.go"},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer tmp.Reset()
+
+	v := newFileSystem(nil, map[string][]byte{filepath.Join(tmp.Src, "holder", "holder.go"): []byte("package holder\n\nfunc (")})
+	ctx := build.Default
+	v.setHooks(&ctx)
+	imp := newSourceImporter(&ctx, token.NewFileSet(), v)
+	// Failed imports report their error every time, rather than an import cycle.
+	for i := 0; i < 2; i++ {
+		if _, err := imp.Import("holder"); err == nil || strings.Contains(err.Error(), "import cycle") {
+			t.Errorf("import %d: expected a parse error, got %v", i, err)
+		}
+	}
+}
+
+func TestSymlinkedGopath(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "stencil_symlink")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "gopath", "src", "use")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	link := filepath.Join(tmp, "link")
+	if err := os.Symlink(filepath.Join(tmp, "gopath"), link); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	ctx := build.Default
+	ctx.GOPATH = link
+	done := make(chan *gopathLayout)
+	go func() {
+		l, err := newGopathLayout(newFileSystem(nil, nil), dir, ctx, "", DefaultOutput)
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		done <- l
+	}()
+	select {
+	case l := <-done:
+		if l != nil && l.vendor != filepath.Join(dir, "vendor") {
+			t.Errorf("expected vendor directory %s, got %s", filepath.Join(dir, "vendor"), l.vendor)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("looking up the vendor directory did not terminate")
+	}
+}
+
+func TestParallel(t *testing.T) {
+	tmp, err := fakegopath.NewTemporaryWithFiles("stencil_parallel", []fakegopath.SourceFile{
+		{Src: "testdata/holder.go", Dest: "holder/holder.go"},
+		{Src: "testdata/holder.use.go", Dest: "use/use.go"},
+		{Src: "std/slice/slice.go", Dest: "slice/slice.go"},
+		{Src: "testdata/sliceset.go", Dest: "sliceset/sliceset.go"},
+		{Src: "testdata/sliceset.use.go", Dest: "use/sliceset.go"},
+		{Src: "testdata/sorted.go", Dest: "sorted/sorted.go"},
+		{Src: "testdata/sorted.multi.use.go", Dest: "bad/use.go"},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer tmp.Reset()
+
+	use := []string{filepath.Join(tmp.Src, "use")}
+	expected, err := processStencil(context.Background(), use, options{workers: 1})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 5; i++ {
+		got, err := processStencil(context.Background(), use, options{workers: 8})
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if len(got) != len(expected) {
+			t.Fatalf("expected %d files, got %d", len(expected), len(got))
+		}
+		for j := range got {
+			if got[j].Path != expected[j].Path || !bytes.Equal(got[j].Data, expected[j].Data) {
+				t.Fatalf("expected %s at %d, got %s", expected[j].Path, j, got[j].Path)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := processStencil(ctx, use, options{}); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+
+	bad := []string{filepath.Join(tmp.Src, "bad")}
+	for _, c := range []struct {
+		opts options
+		errs int
+	}{
+		{options{workers: 1}, 2},
+		{options{workers: 1, failFast: true}, 1},
+	} {
+		_, err := processStencil(context.Background(), bad, c.opts)
+		if errs, ok := err.(Errors); !ok || len(errs) != c.errs {
+			t.Errorf("%+v: expected %d errors, got %v", c.opts, c.errs, err)
+		}
+	}
+}
+
+// memWriter records the files written to it.
+type memWriter map[string][]byte
+
+func (m memWriter) WriteFile(path string, data []byte) error {
+	m[path] = data
+	return nil
+}
+
+// logRecorder records logged messages.
+type logRecorder []string
+
+func (l *logRecorder) Printf(format string, v ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, v...))
+}
+
+func TestGenerator(t *testing.T) {
+	tmp, err := fakegopath.NewTemporaryWithFiles("stencil_generator", []fakegopath.SourceFile{
+		{Src: "testdata/set.go", Dest: "collections/set/set.go"},
+		{Src: "testdata/set.intersect.go", Dest: "examples/setexamples/intersect.go"},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer tmp.Reset()
+
+	src := []string{filepath.Join(tmp.Src, "examples/setexamples/intersect.go")}
+	gen := filepath.Join(tmp.Src, "examples/gen")
+	w, logs := memWriter{}, logRecorder{}
+	g := NewGenerator(Options{OutputDir: gen, Writer: w, Logger: &logs, Workers: 2})
+	files, err := g.Process(context.Background(), src)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(files) != 2 || len(w) != 2 || len(logs) != 2 {
+		t.Fatalf("expected 2 files written and logged, got %d files, %d written, logs %v", len(files), len(w), logs)
+	}
+	if _, ok := w[filepath.Join(gen, "collections/set/Element/string/set.go")]; !ok {
+		t.Errorf("expected the stencilled package in %s, got %v", gen, files)
+	}
+	if imp := `"examples/gen/collections/set/Element/string"`; !bytes.Contains(w[src[0]], []byte(imp)) {
+		t.Errorf("expected %s to import %s, got:\n%s", src[0], imp, w[src[0]])
+	}
+	if _, err := os.Stat(gen); !os.IsNotExist(err) {
+		t.Errorf("expected nothing written to disk, got %v", err)
+	}
+
+	files, err = NewGenerator(Options{DryRun: true}).Process(context.Background(), src)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected 1 file, got %d", len(files))
+	}
+	if _, err := os.Stat(filepath.Join(tmp.Src, "examples/setexamples/vendor")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing written on a dry run, got %v", err)
+	}
+
+	if _, err := NewGenerator(Options{OutputDir: os.TempDir()}).Generate(context.Background(), src); err == nil {
+		t.Error("expected an error for an output directory outside GOPATH")
+	}
+	// Files formatted on disk keep their mode.
+	if err := os.Chmod(src[0], 0600); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err := NewGenerator(Options{Format: true}).Process(context.Background(), src); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	s, err := os.Stat(src[0])
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if s.Mode().Perm() != 0600 {
+		t.Errorf("expected %s to keep mode 0600, got %v", src[0], s.Mode())
+	}
+
+	// Packages matched by patterns are formatted.
+	unformatted := filepath.Join(tmp.Src, "examples/setexamples/format.go")
+	if err := ioutil.WriteFile(unformatted, []byte("package setexamples\nfunc  f() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewGenerator(Options{Format: true}).Process(context.Background(), []string{filepath.Join(tmp.Src, "examples") + "/..."}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if b, err := ioutil.ReadFile(unformatted); err != nil || string(b) != "package setexamples\n\nfunc f() {}\n" {
+		t.Errorf("expected %s to be formatted, got %q, %v", unformatted, b, err)
+	}
+}
+
+func TestFS(t *testing.T) {
+	read := func(p string) *fstest.MapFile {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &fstest.MapFile{Data: b}
+	}
+	fsys := fstest.MapFS{
+		"gopath/src/collections/set/set.go":            read("testdata/set.go"),
+		"gopath/src/examples/setexamples/intersect.go": read("testdata/set.intersect.go"),
+		"mod/go.mod":                            read("testdata/mod.gomod"),
+		"mod/collections/set/set.go":            read("testdata/set.go"),
+		"mod/examples/setexamples/intersect.go": read("testdata/set.intersect.mod.go"),
+	}
+	ctx := build.Default
+	ctx.GOPATH = "/gopath"
+
+	w := memWriter{}
+	g := NewGenerator(Options{FS: fsys, BuildContext: &ctx, Writer: w})
+	if _, err := g.Process(context.Background(), []string{"/gopath/src/examples/setexamples", "/mod/examples/setexamples"}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := map[string]string{
+		"/gopath/src/examples/setexamples/vendor/collections/set/Element/string/set.go": "testdata/set.string.golden",
+		"/mod/generated/example.com/mod/collections/set/Element/string/set.go":          "testdata/set.string.mod.golden",
+		"/mod/examples/setexamples/intersect.go":                                        "testdata/set.intersect.mod.golden",
+	}
+	if len(w) != len(expected) {
+		t.Errorf("expected %d files, got %d", len(expected), len(w))
+	}
+	for p, golden := range expected {
+		if !bytes.Equal(w[p], read(golden).Data) {
+			t.Errorf("%s: expected output:\n%s\ngot:\n%s", p, read(golden).Data, w[p])
+		}
+	}
+
+	// Unsaved changes in the overlay are used instead of the files in fsys.
+	src := "/gopath/src/examples/setexamples/intersect.go"
+	w = memWriter{}
+	g = NewGenerator(Options{FS: fsys, BuildContext: &ctx, Writer: w, Overlay: map[string][]byte{
+		src: bytes.Replace(fsys[src[1:]].Data, []byte("Element/string"), []byte("Element/int"), 1),
+	}})
+	if _, err := g.Process(context.Background(), []string{src}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, ok := w["/gopath/src/examples/setexamples/vendor/collections/set/Element/int/set.go"]; !ok || len(w) != 1 {
+		t.Errorf("expected the int set to be generated, got %v", w)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stencil_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sub := filepath.Join(dir, "a/b")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := FindConfig(sub); err != nil || c != nil {
+		t.Fatalf("expected no config, got %+v, %v", c, err)
+	}
+
+	for _, c := range []struct {
+		file, config string
+		output       OutputMode
+		dir          string
+	}{
+		{"stencil.json", `{"output": "root-vendor"}`, RootVendor, ""},
+		{"stencil.json", `{"Output": "generated"}`, GeneratedDir, ""},
+		{"stencil.json", `{"output": "internal/gen"}`, DefaultOutput, filepath.Join(dir, "internal/gen")},
+		{"stencil.yaml", "output: /tmp/gen\n", DefaultOutput, "/tmp/gen"},
+	} {
+		p := filepath.Join(dir, c.file)
+		if err := ioutil.WriteFile(p, []byte(c.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := FindConfig(sub)
+		os.Remove(p)
+		if err != nil {
+			t.Fatalf("%s: %+v", c.config, err)
+		}
+		if cfg == nil || cfg.Dir != dir {
+			t.Fatalf("%s: expected config in %s, got %+v", c.config, dir, cfg)
+		}
+		opts := Options{OutputDir: "other"}
+		cfg.Apply(&opts)
+		if opts.Output != c.output || opts.OutputDir != c.dir {
+			t.Errorf("%s: expected output %v in %q, got %v in %q", c.config, c.output, c.dir, opts.Output, opts.OutputDir)
+		}
+	}
+
+	yml := `format: true
+specializations:
+  - stencil: std/slice
+    substitutions: {T: int}
+    package: ints
+  - stencil: collections/cache
+    substitutions:
+      V: int
+      K: string
+    output: generated
+  - stencil: collections/cache
+defaults:
+  collections/cache: {K: string}
+`
+	if err := ioutil.WriteFile(filepath.Join(sub, "stencil.yaml"), []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := FindConfig(sub)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !cfg.Format || len(cfg.Specializations) != 3 {
+		t.Fatalf("expected formatting and 3 specializations, got %+v", cfg)
+	}
+	for i, want := range []string{"std/slice/_/T/int", "collections/cache/_/K/string/V/int", "collections/cache/_"} {
+		if p := cfg.Specializations[i].path(); p != want {
+			t.Errorf("expected path %s, got %s", want, p)
+		}
+		if d := cfg.Specializations[i].Dir; d != sub {
+			t.Errorf("%s: expected dir %s, got %s", want, sub, d)
+		}
+	}
+	if n := cfg.Specializations[0].Package; n != "ints" {
+		t.Errorf("expected package ints, got %s", n)
+	}
+	opts := Options{Defaults: map[string]map[string]string{"collections/cache": {"K": "int"}}}
+	cfg.Apply(&opts)
+	if k := opts.Defaults["collections/cache"]["K"]; k != "int" {
+		t.Errorf("expected the default of K in options to be kept, got %s", k)
+	}
+	opts = Options{}
+	cfg.Apply(&opts)
+	if k := opts.Defaults["collections/cache"]["K"]; k != "string" {
+		t.Errorf("expected the configured default of K, got %s", k)
+	}
+
+	for config, msg := range map[string]string{
+		`{"output": `: "invalid config",
+		`{"specializations": [{"substitutions": {"T": "int"}}]}`: "specialization 1 has no stencil",
+		`{"defaults": {"std/slice": {"T": "map~int"}}}`:          "default of T in std/slice",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(sub, "stencil.json"), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadConfig(filepath.Join(sub, "stencil.json")); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expected error containing %q, got %v", config, msg, err)
+		}
+	}
+	if _, err := FindConfig(sub); err == nil || !strings.Contains(err.Error(), "both stencil.yaml and stencil.json") {
+		t.Errorf("expected an error for both config files, got %v", err)
 	}
 }
@@ -0,0 +1,29 @@
+package annotated
+
+// K is the type of the keys.
+//
+//stencil:param
+type K interface{}
+
+type (
+	// V is the type of the values.
+	V interface{} //stencil:param
+	// Entry is a key and its value.
+	Entry struct {
+		Key   K
+		Value V
+	}
+)
+
+// Of returns the entry for k and v.
+func Of(k K, v V) Entry {
+	return Entry{Key: k, Value: v}
+}
+
+// Count is the type of the number of entries.
+type Count int
+
+// Len returns the number of entries in es.
+func Len(es []Entry) Count {
+	return Count(len(es))
+}
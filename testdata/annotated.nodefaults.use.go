@@ -0,0 +1,7 @@
+package use
+
+import (
+	"annotated/_"
+)
+
+var _ = annotated.Of
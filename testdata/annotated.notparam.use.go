@@ -0,0 +1,7 @@
+package use
+
+import (
+	"annotated/_/Count/int64"
+)
+
+var _ = annotated.Of
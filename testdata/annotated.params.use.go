@@ -0,0 +1,7 @@
+package use
+
+import (
+	"annotated/_/K/string/V/int"
+)
+
+var _ = annotated.Of
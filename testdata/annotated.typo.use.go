@@ -0,0 +1,7 @@
+package use
+
+import (
+	"annotated/_/Vv/int"
+)
+
+var _ = annotated.Of
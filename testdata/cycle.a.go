@@ -0,0 +1,9 @@
+package a
+
+import (
+	b "b/T/T"
+)
+
+type T interface{}
+
+func A(t T) { b.B(t) }
@@ -0,0 +1,9 @@
+package b
+
+import (
+	a "a/T/T"
+)
+
+type T interface{}
+
+func B(t T) { a.A(t) }
@@ -0,0 +1,7 @@
+package use
+
+import (
+	int_a "a/T/int"
+)
+
+func Use() { int_a.A(1) }
@@ -0,0 +1,7 @@
+package use
+
+import (
+	"defaulted/_"
+)
+
+var _ defaulted.Cache
@@ -0,0 +1,20 @@
+package defaulted
+
+// K is the type of the keys.
+//
+//stencil:param default=string
+type K interface{}
+
+// V is the type of the values.
+//
+//stencil:param default=int
+type V interface{}
+
+// Cache maps keys to values.
+type Cache map[K]V
+
+// Get returns the value of k in c, and whether c holds k.
+func (c Cache) Get(k K) (V, bool) {
+	v, ok := c[k]
+	return v, ok
+}
@@ -0,0 +1,7 @@
+package use
+
+import (
+	"defaulted/V/float64"
+)
+
+var _ defaulted.Cache
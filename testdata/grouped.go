@@ -0,0 +1,21 @@
+package grouped
+
+// Types of the pairs.
+type (
+	// Key is the type of the key of a pair.
+	Key interface{}
+	// Pair holds a key and its value.
+	Pair struct {
+		Key   Key
+		Value Value
+	}
+	// Value is the type of the value of a pair.
+	Value interface{} // Replaced by the value type.
+	// Pairs is a list of pairs.
+	Pairs []Pair
+)
+
+// Of returns a pair holding k and v.
+func Of(k Key, v Value) Pair {
+	return Pair{Key: k, Value: v}
+}
@@ -0,0 +1,9 @@
+package use
+
+import (
+	"grouped/Key/string/Value/int"
+)
+
+func Count(name string, n int) grouped.Pairs {
+	return grouped.Pairs{grouped.Of(name, n)}
+}
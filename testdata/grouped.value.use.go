@@ -0,0 +1,9 @@
+package use
+
+import (
+	"grouped/Value/int"
+)
+
+func Count(name string, n int) grouped.Pair {
+	return grouped.Of(name, n)
+}
@@ -0,0 +1,15 @@
+package holder
+
+// Value is the type of value held.
+type Value interface{}
+
+// Holder holds a list of values.
+type Holder struct {
+	values []Value
+}
+
+// Add adds v to h.
+func (h *Holder) Add(v Value) { h.values = append(h.values, v) }
+
+// Get returns the ith value in h.
+func (h *Holder) Get(i int) Value { return Value(h.values[i]) }
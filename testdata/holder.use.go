@@ -0,0 +1,15 @@
+package use
+
+import (
+	"bytes"
+
+	buffers "holder/Value/ptr~bytes.Buffer"
+	ids "holder/Value/map~string~slice~domain+user.ID"
+	recv "holder/Value/recvchan~int"
+)
+
+func Hold(b *bytes.Buffer) (buffers.Holder, ids.Holder, recv.Holder) {
+	var h buffers.Holder
+	h.Add(b)
+	return h, ids.Holder{}, recv.Holder{}
+}
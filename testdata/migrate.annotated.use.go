@@ -0,0 +1,19 @@
+package use
+
+import (
+	"annotated/_/K/string/V/int"
+)
+
+// Entries returns the entries for the keys in ks, with their indexes as values.
+func Entries(ks []string) []annotated.Entry {
+	var es []annotated.Entry
+	for i, k := range ks {
+		es = append(es, annotated.Of(k, i))
+	}
+	return es
+}
+
+// Count returns the number of entries for ks.
+func Count(ks []string) annotated.Count {
+	return annotated.Len(Entries(ks))
+}
@@ -0,0 +1,10 @@
+package use
+
+import (
+	"num/Number/int32"
+)
+
+// Range returns the difference between the largest and smallest of n.
+func Range(n ...int32) int32 {
+	return num.Max(n...) - num.Min(n...)
+}
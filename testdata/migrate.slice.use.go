@@ -0,0 +1,16 @@
+package use
+
+import (
+	"fmt"
+	"slice/T/string"
+
+	int_slice "slice/T/int"
+)
+
+// Print prints the index of 2 in the sorted ints, and the words in reverse.
+func Print(ints []int, words []string) {
+	int_slice.Sort(ints, func(a, b int) bool { return a < b })
+	fmt.Println(int_slice.Index(ints, 2))
+	slice.Reverse(words)
+	fmt.Println(words)
+}
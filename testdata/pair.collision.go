@@ -0,0 +1,2 @@
+// Package string is a package whose import path collides with a parameter of the pair stencil.
+package string
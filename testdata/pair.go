@@ -0,0 +1,16 @@
+package pair
+
+// K is the type of keys.
+type K interface{}
+
+// V is the type of values.
+type V interface{}
+
+// Pair is a key and a value.
+type Pair struct {
+	Key   K
+	Value V
+}
+
+// Of returns the pair of k and v.
+func Of(k K, v V) Pair { return Pair{Key: k, Value: v} }
@@ -0,0 +1,9 @@
+package use
+
+import (
+	"pair/_/K/string/V/int"
+)
+
+func Count(name string, n int) pair.Pair {
+	return pair.Of(name, n)
+}
@@ -0,0 +1,15 @@
+package set_example
+
+import (
+	"fmt"
+
+	string_set "example.com/mod/collections/set/Element/string"
+)
+
+func Common(list1, list2 []string) []string {
+	return string_set.Of(list1...).Intersection(string_set.Of(list2...)).AsSlice()
+}
+
+func PrintCommon(list1, list2 []string) {
+	fmt.Println(Common(list1, list2))
+}
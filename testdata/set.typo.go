@@ -0,0 +1,9 @@
+package set_example
+
+import (
+	string_set "collections/set/Elemnt/string"
+)
+
+func Common(list1, list2 []string) []string {
+	return string_set.Of(list1...).Intersection(string_set.Of(list2...)).AsSlice()
+}
@@ -0,0 +1,10 @@
+package set_example
+
+import (
+	"collections/set/bool/int"
+)
+
+func Has(s set.Set, e interface{}) bool {
+	_, ok := s[e]
+	return ok
+}
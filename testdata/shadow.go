@@ -0,0 +1,21 @@
+package shadow
+
+// T is the type held by a Box.
+type T interface{}
+
+// Box holds a single T.
+type Box struct {
+	T T
+}
+
+// Get returns the value held by b.
+func (b Box) Get() T { return b.T }
+
+// Set sets the value held by b to v.
+func (b *Box) Set(v T) { b.T = v }
+
+// Count returns the number of elements in s.
+func Count(s []T) int {
+	T := len(s)
+	return T
+}
@@ -0,0 +1,9 @@
+package use
+
+import (
+	string_shadow "shadow/T/string"
+)
+
+func Hold(s string) string {
+	return string_shadow.Box{T: s}.Get()
+}
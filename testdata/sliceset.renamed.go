@@ -0,0 +1,19 @@
+package sliceset
+
+import (
+	"slice/T/Element"
+)
+
+// Element is the type of element held by the set.
+type Element interface{}
+
+// Set is a set of Element values, in the order they were added.
+type Set []Element
+
+// Add returns s with e added to it, if it isn't already present.
+func (s Set) Add(e Element) Set {
+	if slice.Index(s, e) >= 0 {
+		return s
+	}
+	return append(s, e)
+}
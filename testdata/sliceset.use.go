@@ -0,0 +1,13 @@
+package use
+
+import (
+	string_set "sliceset/Element/string"
+)
+
+func Unique(s ...string) []string {
+	var set string_set.Set
+	for _, e := range s {
+		set = set.Add(e)
+	}
+	return set
+}
@@ -0,0 +1,18 @@
+package sorted
+
+// T is the type of element in a sorted list.
+type T interface {
+	Less(T) bool
+}
+
+// Insert inserts e into the sorted list l, returning the new list.
+func Insert(l []T, e T) []T {
+	i := 0
+	for i < len(l) && l[i].Less(e) {
+		i++
+	}
+	l = append(l, e)
+	copy(l[i+1:], l[i:])
+	l[i] = e
+	return l
+}
@@ -0,0 +1,9 @@
+package use
+
+import (
+	ints "sorted/T/int"
+)
+
+func Add(l []int, v int) []int {
+	return ints.Insert(l, v)
+}
@@ -0,0 +1,8 @@
+package use
+
+import (
+	ints "sorted/T/int"
+	strs "sorted/T/string"
+)
+
+var _, _ = ints.Insert, strs.Insert
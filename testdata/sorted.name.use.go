@@ -0,0 +1,7 @@
+package use
+
+import (
+	names "sorted/T/domain+version.Name"
+)
+
+var _ = names.Insert
@@ -0,0 +1,11 @@
+package use
+
+import (
+	"domain/version"
+
+	versions "sorted/T/domain+version.V"
+)
+
+func Add(l []version.V, v version.V) []version.V {
+	return versions.Insert(l, v)
+}
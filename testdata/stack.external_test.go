@@ -0,0 +1,17 @@
+package stack_test
+
+import (
+	"testing"
+
+	"stack"
+)
+
+func TestPop(t *testing.T) {
+	var s stack.Stack
+	var e stack.T
+	s.Push(e)
+	if s.Pop() != e {
+		t.Errorf("expected %v", e)
+	}
+	var _ []stack.T = s
+}
@@ -0,0 +1,17 @@
+package stack
+
+// T is the type of element in a Stack.
+type T interface{}
+
+// Stack is a last in, first out stack of T.
+type Stack []T
+
+// Push pushes e on to s.
+func (s *Stack) Push(e T) { *s = append(*s, e) }
+
+// Pop removes the top element of s and returns it.
+func (s *Stack) Pop() T {
+	e := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	return e
+}
@@ -0,0 +1,12 @@
+package stack
+
+import "testing"
+
+func TestPush(t *testing.T) {
+	var s Stack
+	var zero T
+	s.Push(zero)
+	if len(s) != 1 {
+		t.Errorf("expected 1 element, got %d", len(s))
+	}
+}
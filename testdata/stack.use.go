@@ -0,0 +1,8 @@
+package use
+
+import (
+	ints "stack/T/int"
+)
+
+// Push pushes e on to s.
+func Push(s *ints.Stack, e int) { s.Push(e) }
@@ -0,0 +1,12 @@
+package use
+
+import (
+	"testing"
+
+	ints "stack/T/int"
+)
+
+func TestStack(t *testing.T) {
+	var s ints.Stack
+	s.Push(1)
+}
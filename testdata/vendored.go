@@ -0,0 +1,8 @@
+package errors
+
+// New returns an error with the message msg.
+func New(msg string) error { return message(msg) }
+
+type message string
+
+func (m message) Error() string { return string(m) }
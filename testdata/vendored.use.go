@@ -0,0 +1,14 @@
+package use
+
+import (
+	f32_basic "basic/int/float32"
+
+	"github.com/pkg/errors"
+)
+
+func CheckMax(f float32) error {
+	if f32_basic.Max(f, 11.0) > f {
+		return errors.New("too small")
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package version
+
+// V is a version number.
+type V struct {
+	Major, Minor int
+}
+
+// Less returns true if v is an earlier version than o.
+func (v V) Less(o V) bool {
+	return v.Major < o.Major || v.Major == o.Major && v.Minor < o.Minor
+}
+
+// Name is the name of a version.
+type Name string
+
+// Less returns true if n sorts before o.
+func (n Name) Less(o string) bool { return string(n) < o }
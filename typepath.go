@@ -0,0 +1,137 @@
+package stencil
+
+import (
+	"go/token"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// typePath is a replacement type decoded from an import path segment.
+type typePath struct {
+	// expr is the Go expression for the type.
+	expr string
+	// imports maps the import paths of packages used by expr to the names expr refers to them by.
+	imports map[string]string
+}
+
+// parseTypePath decodes an import path segment into a Go type. The grammar is
+//
+//	Type      = Name | Qualified | Pointer | Slice | Array | Map | Chan
+//	Name      = identifier
+//	Qualified = PkgPath "." identifier
+//	PkgPath   = import path with each "/" written as "+"
+//	Pointer   = "ptr" "~" Type
+//	Slice     = "slice" "~" Type
+//	Array     = "array" "~" length "~" Type
+//	Map       = "map" "~" Type "~" Type
+//	Chan      = ( "chan" | "recvchan" | "sendchan" ) "~" Type
+//
+// For example "map~string~ptr~github.com+foo+bar.Baz" is map[string]*bar.Baz, with bar imported from
+// "github.com/foo/bar".
+func parseTypePath(seg string) (*typePath, error) {
+	p := &typePathParser{toks: strings.Split(seg, "~"), t: &typePath{imports: map[string]string{}}}
+	expr, err := p.parse()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: invalid type", seg)
+	}
+	if len(p.toks) != 0 {
+		return nil, errors.Errorf("%s: invalid type: unexpected %q", seg, strings.Join(p.toks, "~"))
+	}
+	p.t.expr = expr
+	return p.t, nil
+}
+
+type typePathParser struct {
+	toks []string
+	t    *typePath
+}
+
+func (p *typePathParser) next() (string, error) {
+	if len(p.toks) == 0 {
+		return "", errors.New("missing type")
+	}
+	tok := p.toks[0]
+	p.toks = p.toks[1:]
+	return tok, nil
+}
+
+func (p *typePathParser) parse() (string, error) {
+	tok, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	switch tok {
+	case "ptr":
+		return p.elem("*")
+	case "slice":
+		return p.elem("[]")
+	case "array":
+		n, err := p.next()
+		if err != nil {
+			return "", err
+		}
+		if _, err := strconv.ParseUint(n, 10, 64); err != nil {
+			return "", errors.Errorf("%q: invalid array length", n)
+		}
+		return p.elem("[" + n + "]")
+	case "map":
+		k, err := p.parse()
+		if err != nil {
+			return "", err
+		}
+		return p.elem("map[" + k + "]")
+	case "chan", "recvchan", "sendchan":
+		e, err := p.parse()
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(e, "<-") {
+			e = "(" + e + ")"
+		}
+		return map[string]string{"chan": "chan ", "recvchan": "<-chan ", "sendchan": "chan<- "}[tok] + e, nil
+	}
+	dot := strings.LastIndex(tok, ".")
+	if dot < 0 {
+		if !token.IsIdentifier(tok) {
+			return "", errors.Errorf("%q: not an identifier", tok)
+		}
+		return tok, nil
+	}
+	pkg, name := strings.Replace(tok[:dot], "+", "/", -1), tok[dot+1:]
+	if pkg == "" || !token.IsExported(name) || !token.IsIdentifier(name) {
+		return "", errors.Errorf("%q: invalid qualified type", tok)
+	}
+	qual := packageName(pkg)
+	p.t.imports[pkg] = qual
+	return qual + "." + name, nil
+}
+
+func (p *typePathParser) elem(prefix string) (string, error) {
+	e, err := p.parse()
+	if err != nil {
+		return "", err
+	}
+	return prefix + e, nil
+}
+
+// packageName returns the name a generated file uses for the package with import path pkg.
+func packageName(pkg string) string {
+	base := path.Base(pkg)
+	// Major version suffixes such as gopkg.in/yaml.v2 are not part of the package name.
+	if i := strings.Index(base, "."); i > 0 {
+		base = base[:i]
+	}
+	name := strings.Map(func(r rune) rune {
+		if r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return '_'
+	}, base)
+	if !token.IsIdentifier(name) {
+		name = "_" + name
+	}
+	return name
+}